@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+const (
+	// The description given to authorizations by versions of heroku-agent
+	// that didn't say which machine created them.
+	LegacyAuthorizationDescription = "heroku-agent"
+)
+
+var (
+	// Identifies this installation of heroku-agent among others on the same
+	// machine and account. It's kept on disk so that a restarted daemon can
+	// still recognize the authorizations that it created.
+	installId string
+)
+
+// An OAuth authorization as listed by the API. Only the fields that we need
+// to recognize our own are decoded.
+type Authorization struct {
+	AccessToken *struct {
+		// Seconds until the token expires, or nil if it never does.
+		ExpiresIn *int `json:"expires_in"`
+	} `json:"access_token"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Id          string    `json:"id"`
+}
+
+type CreateAuthorizationRequest struct {
+	Description   string `json:"description"`
+	ExpiresIn     int    `json:"expires_in"`
+	SkipTwoFactor bool   `json:"skip_two_factor"`
+}
+
+type CreateAuthorizationResponse struct {
+	AccessToken struct {
+		ExpiresIn int    `json:"expires_in"`
+		Token     string `json:"token"`
+	} `json:"access_token"`
+	Id string `json:"id"`
+}
+
+// Describes a new authorization so that it's clear from the account's list of
+// authorizations where it came from, like:
+//
+//	heroku-agent on laptop for brandur, install 5f2b9c0e8d1a4b7c, version 0.1.0, created 2015-01-02T15:04:05Z
+func authorizationDescription(createdAt time.Time) string {
+	return fmt.Sprintf("%s, install %s, version %s, created %s",
+		authorizationOwner(), installId, Version, createdAt.UTC().Format(time.RFC3339))
+}
+
+// Identifies the machine and local user that authorizations are created by,
+// so that any left behind by a previous daemon can be recognized later.
+func authorizationOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	if username == "" {
+		username = "unknown"
+	}
+
+	return fmt.Sprintf("heroku-agent on %s for %s", hostname, username)
+}
+
+// Creates an authorization that can skip two factor checks. Either auth must
+// already be able to skip them, or a code must be sent along with it.
+func createSkipTwoFactorToken(host string, auth string, code string, lifetime time.Duration) (*SecondFactor, error) {
+	requestData := &CreateAuthorizationRequest{
+		Description:   authorizationDescription(time.Now()),
+		ExpiresIn:     int(lifetime / time.Second),
+		SkipTwoFactor: true,
+	}
+
+	req, err := newApiRequest("POST", host, "/oauth/authorizations", auth, requestData)
+	if err != nil {
+		return nil, err
+	}
+
+	if code != "" {
+		req.Header.Set("Heroku-Two-Factor-Code", code)
+	}
+
+	responseData := &CreateAuthorizationResponse{}
+	err = doApiRequest(req, 201, responseData)
+	if err != nil {
+		return nil, err
+	}
+
+	secondFactor := &SecondFactor{
+		expiresAt: time.Now().Add(time.Duration(responseData.AccessToken.ExpiresIn) * time.Second),
+		host:      host,
+		id:        responseData.Id,
+		token:     responseData.AccessToken.Token,
+	}
+	return secondFactor, nil
+}
+
+// Deletes an authorization, which also revokes its token. An authorization
+// that's already gone is not an error.
+func deleteAuthorization(host string, auth string, id string) error {
+	req, err := newApiRequest("DELETE", host, "/oauth/authorizations/"+id, auth, nil)
+	if err != nil {
+		return err
+	}
+
+	err = doApiRequest(req, 200, nil)
+	if err, ok := err.(*unexpectedStatusError); ok && err.status == 404 {
+		return nil
+	}
+	return err
+}
+
+func listAuthorizations(host string, auth string) ([]Authorization, error) {
+	req, err := newApiRequest("GET", host, "/oauth/authorizations", auth, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizations := make([]Authorization, 0)
+	err = doApiRequest(req, 200, &authorizations)
+	if err != nil {
+		return nil, err
+	}
+	return authorizations, nil
+}
+
+// Whether an authorization was created by this installation of heroku-agent
+// before the given time and left behind, given the IDs of those that are
+// still held. Authorizations from other installations are left alone unless
+// they're from an older heroku-agent and have already expired, in which case
+// they're no use to anyone.
+func isOrphanedAuthorization(a *Authorization, heldIds map[string]bool, before time.Time) bool {
+	if heldIds[a.Id] || !a.CreatedAt.Before(before) {
+		return false
+	}
+
+	if installId != "" && strings.HasPrefix(a.Description, "heroku-agent on ") &&
+		strings.Contains(a.Description, ", install "+installId+",") {
+		return true
+	}
+
+	if a.Description == LegacyAuthorizationDescription {
+		return a.AccessToken != nil && a.AccessToken.ExpiresIn != nil &&
+			*a.AccessToken.ExpiresIn <= 0
+	}
+
+	return false
+}
+
+// Whether a host serves the platform API, which is the only place that
+// authorizations can be listed.
+func isApiHost(host string) bool {
+	return strings.HasPrefix(canonicalHost(host), "api.")
+}
+
+type unexpectedStatusError struct {
+	status int
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("Unexpected response code: %v", e.status)
+}
+
+// Makes a request to the API, decoding the response into v if it's not nil.
+func doApiRequest(req *http.Request, expectedStatus int, v interface{}) error {
+	resp, err := DoRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return &unexpectedStatusError{status: resp.StatusCode}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	encoded, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, v)
+}
+
+// Builds a request to the API with a JSON-encoded body if one is given.
+func newApiRequest(method string, host string, path string, auth string, body interface{}) (*http.Request, error) {
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, "https://"+host+path, bytes.NewBuffer(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
+	req.Header.Set("Authorization", auth)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
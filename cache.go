@@ -1,14 +1,31 @@
 package main
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	DefaultCacheMaxBytes = 32 * 1024 * 1024
+	DefaultCacheMaxCount = 2000
+
+	// How long an entry is retained for revalidation when the response didn't
+	// ask for it to be kept fresh for any longer.
+	CacheRetention = 60 * time.Minute
+)
+
 var (
 	cache          *RequestCache
 	contentHeaders map[string]bool
@@ -16,82 +33,474 @@ var (
 
 type CachedResponse struct {
 	content   []byte
+	digest    string
+	element   *list.Element
 	etag      string
 	expiresAt time.Time
 	header    http.Header
+	key       string
+	size      int
+
+	// Used to revalidate with `If-Modified-Since` when there's no etag.
+	lastModified string
+
+	// Identify the resource independently of its key so that entries can be
+	// invalidated by a mutating request to the same resource. Like the key,
+	// auth is derived from the authorization rather than containing it.
+	auth string
+	host string
+	path string
+
+	// A fingerprint of the authorization for display.
+	fingerprint string
+
+	// The full requested URL, including its query string, kept for display.
+	url string
+
+	// The key of the request without any variation, under which all the
+	// variants of a resource are grouped.
+	primaryKey string
+
+	// The values of the request headers named by the response's `Vary` when
+	// this entry was stored. A request is served by this entry only if it has
+	// the same values.
+	vary map[string]string
+
+	// Until this time the entry may be served without revalidation, as
+	// determined by `Cache-Control: max-age` or `Expires`. It's zero for
+	// responses that didn't specify freshness or asked for `no-cache`.
+	freshUntil time.Time
+
+	// Set by `must-revalidate`, which means that once stale, this entry must
+	// never be served without a successful revalidation.
+	mustRevalidate bool
+
+	// Whether this entry records that the resource doesn't exist, with a 404
+	// or 410. Such an entry has no validators, so it's only served while it's
+	// fresh and is dropped as soon as it isn't.
+	negative bool
+
+	// Whether a background revalidation for this entry is in flight.
+	revalidating bool
+
+	// The status of the original response, which is 206 for pages of a list
+	// that aren't the last.
+	status int
+
+	// When the entry was last stored or confirmed current by a 304.
+	validatedAt time.Time
+}
+
+// A body held once on behalf of every entry with identical content, which is
+// common when the same resource is cached under several authorizations.
+type cachedBody struct {
+	content []byte
+	refs    int
+}
+
+// Tracks the headers named by `Vary` on the most recent response stored for a
+// primary key, along with how many variants of it are being held.
+type varyRecord struct {
+	count   int
+	headers []string
+}
+
+// A summary of a cached entry, as shown by `heroku-agent cache list`.
+type CacheEntry struct {
+	Age          time.Duration
+	Auth         string
+	Etag         string
+	ExpiresAt    time.Time
+	Host         string
+	Id           string
+	LastModified string
+	Size         int
+	Url          string
+}
+
+// Everything about a cached entry, as shown by `heroku-agent cache show`.
+type CacheEntryDetail struct {
+	CacheEntry
+	Content    []byte
+	FreshUntil time.Time
+	Header     http.Header
+	Status     int
+	Vary       map[string]string
+}
+
+// Filters for `heroku-agent cache purge`. An entry is purged only if it
+// matches all of the filters that are set.
+type CachePurgeArgs struct {
+	Host       string
+	OlderThan  time.Duration
+	PathPrefix string
+}
+
+// Describes how a response may be cached according to its `Cache-Control` and
+// `Expires` headers.
+type cacheability struct {
+	freshUntil     time.Time
+	mustRevalidate bool
+	noStore        bool
 }
 
 type RequestCache struct {
+	bodyMap  map[string]*cachedBody
 	cacheMap map[string]*CachedResponse
+	disk     *DiskStore
 	mutex    *sync.Mutex
+	statsMap map[string]*CacheStats
+	varyMap  map[string]*varyRecord
+
+	// Entries ordered from most to least recently used. When the cache goes
+	// over either of its limits, entries are evicted from the back. Size
+	// counts each distinct body only once, however many entries share it.
+	lru      *list.List
+	maxBytes int
+	maxCount int
+	size     int
+
+	// How stale an entry may be and still be served immediately while it's
+	// revalidated in the background. Zero disables the behavior.
+	staleWhileRevalidate time.Duration
+
+	// Whether, and how stale, an entry may be served when the API can't be
+	// reached.
+	staleOnError staleOnErrorPolicy
+
+	// How long a 404 or 410 is cached for. Zero disables negative caching.
+	negativeTtl time.Duration
+
+	// Rules from the policy file and from `HEROKU_AGENT_FRESH_WINDOWS` that
+	// override the defaults above for matching requests.
+	policyRules []PolicyRule
+}
+
+// Describes when a cached entry may be served in place of an upstream error.
+// A zero maxStale means that there's no limit on how stale the entry may be.
+type staleOnErrorPolicy struct {
+	enabled  bool
+	maxStale time.Duration
 }
 
 func init() {
 	cache = &RequestCache{
+		bodyMap:  make(map[string]*cachedBody),
 		cacheMap: make(map[string]*CachedResponse),
+		lru:      list.New(),
+		maxBytes: DefaultCacheMaxBytes,
+		maxCount: DefaultCacheMaxCount,
 		mutex:    &sync.Mutex{},
+		statsMap: make(map[string]*CacheStats),
+		varyMap:  make(map[string]*varyRecord),
+
+		staleOnError: staleOnErrorPolicy{enabled: true},
 	}
 	contentHeaders = map[string]bool{
+		"Accept-Ranges":    true,
 		"Content-Encoding": true,
 		"Content-Length":   true,
+		"Content-Range":    true,
 		"Content-Type":     true,
+		"Next-Range":       true,
 		"Status":           true,
 	}
 }
 
+// Returns the number of distinct bodies held, which is less than the number of
+// entries when some of them share a body.
+func CacheBodyCount() int {
+	return cache.bodyCount()
+}
+
 func CacheCount() int {
 	return cache.count()
 }
 
+func CacheLimits() (int, int) {
+	return cache.maxBytes, cache.maxCount
+}
+
+func CacheSize() int {
+	return cache.bytes()
+}
+
+func ListCache() []CacheEntry {
+	return cache.list()
+}
+
+func PurgeCache(args CachePurgeArgs) int {
+	return cache.purge(args)
+}
+
+func ShowCache(id string) (*CacheEntryDetail, error) {
+	return cache.show(id)
+}
+
 func CacheHandler(r *http.Request, next NextHandlerFunc) (*httptest.ResponseRecorder, error) {
+	if r.Method == "GET" && r.Header.Get("Authorization") != "" {
+		logger.Printf("[policy] %s%s: %s\n", r.Host, safeUrl(r.URL),
+			cache.policyFor(r).String())
+	}
+
 	cached, isCached := cache.getCache(r)
 
-	// don't try our cache if the client sent their own cache attempt
-	if _, ok := r.Header["If-None-Match"]; ok {
-		isCached = false
+	// If the client sent its own conditional request, take its validators off
+	// so that we can revalidate our entry instead, then answer its condition
+	// ourselves once we know what's current. Without an entry, the request
+	// goes upstream untouched.
+	var conditions http.Header
+	if isCached {
+		conditions = takeConditionalHeaders(r)
 	}
 
-	if isCached {
-		r.Header.Set("If-None-Match", cached.etag)
+	w, err := serveWithCache(r, next, cached, isCached)
+	if err == nil && conditions != nil {
+		w = answerConditionalRequest(conditions, w)
 	}
 
-	w, err := next(r)
+	return w, err
+}
 
-	if isCached && (w.Code == 304 || err != nil) {
-		// This circuit breaker allows a fallback to cache if there was a
-		// problem upstream. I haven't noticed any negative side effects so
-		// far, but this may be removed in a future version.
-		if err != nil {
-			logger.Printf("[cache] error: %s\n", err.Error())
-			logger.Printf("[cache] Error upstream; responding with cache response\n",
-				err.Error())
+// Answers a client's conditional request given the response that would
+// otherwise be sent to it, responding with a 304 if the client's copy is
+// still current.
+func answerConditionalRequest(conditions http.Header, w *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	if w.Code != 200 || !conditionsMatch(conditions, w.Header()) {
+		return w
+	}
+
+	logger.Printf("[cache] Client's copy is current; responding with 304\n")
+
+	newWriter := httptest.NewRecorder()
+	copyHeaders(w.Header(), newWriter.Header())
+	for k, _ := range contentHeaders {
+		newWriter.Header().Del(k)
+	}
+	newWriter.WriteHeader(304)
+	return newWriter
+}
+
+// Builds a response from a cached entry, starting from the headers of the
+// upstream response if there was one.
+func cachedRecorder(header http.Header, cached *CachedResponse) *httptest.ResponseRecorder {
+	newWriter := httptest.NewRecorder()
+
+	// remove headers that may be inaccurate on a cached response
+	for k, _ := range contentHeaders {
+		header.Del(k)
+	}
+	copyHeaders(header, newWriter.Header())
+	copyHeaders(cached.header, newWriter.Header())
+
+	// include validators so that clients can make conditional requests of
+	// their own
+	if cached.etag != "" {
+		newWriter.Header().Set("Etag", cached.etag)
+	}
+	if cached.lastModified != "" {
+		newWriter.Header().Set("Last-Modified", cached.lastModified)
+	}
+
+	newWriter.WriteHeader(cached.statusCode())
+	newWriter.Write(cached.content)
+
+	return newWriter
+}
+
+// Checks whether a client's `If-None-Match` or `If-Modified-Since` is
+// satisfied by a response's validators. As with any HTTP server,
+// `If-Modified-Since` is only considered without `If-None-Match`.
+func conditionsMatch(conditions http.Header, header http.Header) bool {
+	if ifNoneMatch := conditions.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("Etag"), "W/")
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" && etag != "" {
+				return true
+			}
+			if etag != "" && strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
 		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(conditions.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ifModifiedSince)
+}
+
+// Serves a request using a cached entry if there is one, revalidating it as
+// necessary, or otherwise stores the response for next time.
+func serveWithCache(r *http.Request, next NextHandlerFunc, cached *CachedResponse, isCached bool) (*httptest.ResponseRecorder, error) {
+	// a client can insist on revalidation, in which case the entry can only
+	// be used if the API confirms that it's still current
+	forceRevalidation := requiresRevalidation(r)
+
+	// a negative entry can't be revalidated, so insisting on it means going
+	// upstream as if there were no entry at all
+	if isCached && cached.negative && forceRevalidation {
+		cached, isCached = nil, false
+	}
+
+	if isCached && !forceRevalidation && cache.isFresh(r, cached) {
+		logger.Printf("[cache] Fresh; responding without revalidation\n")
+		return cachedRecorder(http.Header{}, cached), nil
+	}
+
+	if isCached && !forceRevalidation && cache.canServeStale(cached) {
+		if cache.startRevalidation(cached) {
+			go revalidate(r, next, cached)
+		}
+		logger.Printf("[cache] Stale; responding while revalidating [staleness=%v]\n",
+			cache.staleness(cached))
+		return cachedRecorder(cache.staleHeader(cached, false), cached), nil
+	}
+
+	if isCached {
+		cached.setConditionalHeaders(r)
+	}
+
+	w, err := next(r)
 
-		newWriter := httptest.NewRecorder()
+	// a successful change to a resource means that what we're holding for it
+	// and the collections it belongs to is now out of date
+	if err == nil && isMutatingMethod(r.Method) && w.Code < 400 {
+		cache.invalidate(r)
+	}
 
-		// remove headers that may be inaccurate on a cached response
-		for k, _ := range contentHeaders {
-			w.Header().Del(k)
+	// This circuit breaker allows a fallback to cache if there was a problem
+	// upstream, as long as the configured policy allows it. The response is
+	// marked so that clients can tell that they may have received stale data.
+	if isCached && err != nil {
+		if !cache.canServeStaleOnError(r, cached) {
+			logger.Printf("[cache] Error upstream; stale-on-error policy forbids cached response\n")
+			return w, err
 		}
-		copyHeaders(w.Header(), newWriter.Header())
-		copyHeaders(cached.header, newWriter.Header())
 
-		newWriter.WriteHeader(200)
-		newWriter.Write(cached.content)
+		logger.Printf("[cache] Error upstream; responding with cached response: %s\n",
+			err.Error())
+		cache.recordStats(canonicalHost(r.Host), func(s *CacheStats) { s.StaleFallbacks++ })
+		return cachedRecorder(cache.staleHeader(cached, true), cached), nil
+	}
+
+	if isCached && w.Code == 304 {
+		cache.refresh(cached, w.Header())
 
 		// move to the new writer reference and discard the old one
-		w = newWriter
+		w = cachedRecorder(w.Header(), cached)
 	} else if err == nil {
-		cache.setCache(r, w.Header(), w.Body.Bytes())
+		cache.setCache(r, w.Code, w.Header(), w.Body.Bytes())
 	}
 
 	return w, err
 }
 
+// Whether the client asked for revalidation with `Cache-Control: no-cache` or
+// `max-age=0`, or the older `Pragma: no-cache`.
+func requiresRevalidation(r *http.Request) bool {
+	directives := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return true
+	}
+	if maxAge, ok := directives["max-age"]; ok && maxAge == "0" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Pragma"), "no-cache")
+}
+
+// Removes a client's validators from a request, returning them or nil if
+// there were none.
+func takeConditionalHeaders(r *http.Request) http.Header {
+	var conditions http.Header
+	for _, h := range []string{"If-Modified-Since", "If-None-Match"} {
+		if v := r.Header.Get(h); v != "" {
+			if conditions == nil {
+				conditions = make(http.Header)
+			}
+			conditions.Set(h, v)
+			r.Header.Del(h)
+		}
+	}
+	return conditions
+}
+
 func ClearCache() {
 	cache.clear()
 }
 
+// Applies the configured memory budget, then enables the on-disk store if a
+// cache directory has been configured and reloads any entries that a previous
+// daemon left behind.
+func InitCache() {
+	cache.maxBytes = getEnvInt("HEROKU_AGENT_CACHE_MAX_BYTES", DefaultCacheMaxBytes)
+	cache.maxCount = getEnvInt("HEROKU_AGENT_CACHE_MAX_COUNT", DefaultCacheMaxCount)
+	cache.staleWhileRevalidate = getEnvDuration("HEROKU_AGENT_STALE_WHILE_REVALIDATE", 0)
+	cache.negativeTtl = getEnvDuration("HEROKU_AGENT_NEGATIVE_TTL", 0)
+
+	if s := os.Getenv("HEROKU_AGENT_STALE_ON_ERROR"); s != "" {
+		policy, err := parseStaleOnError(s)
+		if err != nil {
+			fail(1, fmt.Errorf("invalid HEROKU_AGENT_STALE_ON_ERROR: %s", err.Error()))
+		}
+		cache.staleOnError = policy
+	}
+
+	// rules from the policy file come first so that they take precedence
+	rules, err := loadPolicyFile(getPolicyFilePath())
+	if err != nil {
+		fail(1, fmt.Errorf("invalid policy file: %s", err.Error()))
+	}
+	cache.policyRules = rules
+
+	if s := os.Getenv("HEROKU_AGENT_FRESH_WINDOWS"); s != "" {
+		windows, err := parseFreshWindows(s)
+		if err != nil {
+			fail(1, fmt.Errorf("invalid HEROKU_AGENT_FRESH_WINDOWS: %s", err.Error()))
+		}
+		cache.policyRules = append(cache.policyRules, windows...)
+	}
+	logger.Printf("[policy] Loaded %v rule(s)\n", len(cache.policyRules))
+
+	dir := getCacheDirPath()
+	if dir == "" {
+		return
+	}
+
+	secret := os.Getenv("HEROKU_AGENT_CACHE_SECRET")
+	disk, err := NewDiskStore(dir, secret)
+	if err != nil {
+		fail(1, err)
+	}
+
+	// persisted keys are derived from authorizations, so with a secret to
+	// make the derivation stable they can still be matched after a restart
+	if secret != "" {
+		authKeySecret, err = deriveKey(secret, "heroku-agent auth keys")
+		if err != nil {
+			fail(1, err)
+		}
+	}
+
+	cache.load(disk)
+}
+
+// Makes any disk writes that are still queued.
+func FlushCache() {
+	if cache.disk != nil {
+		cache.disk.flush()
+	}
+}
+
 func ReapCache() {
 	for {
 		select {
@@ -101,21 +510,111 @@ func ReapCache() {
 	}
 }
 
+// Writes entries to disk in the background as they're stored, if the cache is
+// being persisted.
+func RunCacheWriter() {
+	if cache.disk != nil {
+		cache.disk.run()
+	}
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case "DELETE", "PATCH", "POST", "PUT":
+		return true
+	}
+	return false
+}
+
+// Produces headers that mark a response served from a stale entry: a
+// `Warning` as described by RFC 7234, and an `Age` along with our own header
+// that carry the number of seconds since the entry was last validated.
+func (c *RequestCache) staleHeader(cached *CachedResponse, revalidationFailed bool) http.Header {
+	// a background revalidation may be refreshing the entry, so what's needed
+	// of it is read under the mutex
+	now := time.Now()
+	c.mutex.Lock()
+	staleness := cached.staleness(now)
+	validatedAt := cached.validatedAt
+	c.mutex.Unlock()
+
+	header := make(http.Header)
+
+	if revalidationFailed {
+		header.Add("Warning", `111 heroku-agent "Revalidation Failed"`)
+	}
+	if staleness > 0 {
+		header.Add("Warning", `110 heroku-agent "Response is Stale"`)
+	}
+
+	age := fmt.Sprintf("%d", int(now.Sub(validatedAt).Seconds()))
+	header.Set("Age", age)
+	header.Set("Heroku-Agent-Stale-Age", age)
+
+	return header
+}
+
+// Performs a conditional request for an entry that was served stale and
+// updates it with the result. This runs after the client has already been
+// answered, so the request is copied rather than reused.
+func revalidate(r *http.Request, next NextHandlerFunc, cached *CachedResponse) {
+	defer cache.finishRevalidation(cached)
+
+	req := new(http.Request)
+	*req = *r
+	req.Body = nil
+	req.Header = make(http.Header)
+	copyHeaders(r.Header, req.Header)
+	cached.setConditionalHeaders(req)
+
+	w, err := next(req)
+	if err != nil {
+		logger.Printf("[cache] Background revalidation failed: %s\n", err.Error())
+		return
+	}
+
+	if w.Code == 304 {
+		cache.refresh(cached, w.Header())
+		logger.Printf("[cache] Background revalidation: not modified\n")
+	} else {
+		cache.setCache(req, w.Code, w.Header(), w.Body.Bytes())
+		logger.Printf("[cache] Background revalidation: updated [status=%v]\n", w.Code)
+	}
+}
+
+// Builds a key from the parts of a request that identify the representation
+// it's asking for. Everything is canonicalized first so that requests which
+// differ only superficially share an entry.
 func (c *RequestCache) buildCacheKey(request *http.Request) string {
-	auth := normalizeAuth(request.Header.Get("Authorization"))
+	auth := cacheIdentity(request.Header.Get("Authorization"))
 	user := request.Header.Get("X-Heroku-Sudo-User")
-	url := request.URL.String()
+	url := canonicalUrl(request.URL)
+
+	// Heroku's API selects a version and a variant through `Accept`, so it
+	// changes the representation as much as the URL does
+	accept := strings.ToLower(canonicalHeaderValue(request.Header.Get("Accept")))
 
-	// Poor man's check on `Vary`: basically take all values on which we should
-	// vary and concatenate them. If a value changes, a new cache key will be
-	// generated.
-	varyHeaders := ""
-	for _, v := range strings.Split(request.Header.Get("Vary"), ",") {
-		varyHeaders += v + ":" + request.Header.Get(v)
+	// list endpoints paginate through `Range`, so every page must be kept
+	// under its own key
+	contentRange := canonicalHeaderValue(request.Header.Get("Range"))
+
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s", auth, user, request.Method,
+		canonicalHost(request.Host), accept, contentRange, url)
+}
+
+// Builds the key that selects a particular variant of a resource by appending
+// the request's values for each of the given `Vary` headers.
+func (c *RequestCache) buildVariantKey(primaryKey string, headers []string, request *http.Request) string {
+	if len(headers) == 0 {
+		return primaryKey
 	}
 
-	return fmt.Sprintf("%s|%s|%s|%s|%s|%s", auth, user, request.Method,
-		request.Host, varyHeaders, url)
+	values := make([]string, len(headers))
+	for i, h := range headers {
+		values[i] = h + ":" + request.Header.Get(h)
+	}
+
+	return primaryKey + "|" + strings.Join(values, ";")
 }
 
 func (c *RequestCache) getCache(request *http.Request) (*CachedResponse, bool) {
@@ -128,38 +627,188 @@ func (c *RequestCache) getCache(request *http.Request) (*CachedResponse, bool) {
 		return nil, false
 	}
 
-	// if `Vary` is set to `*` we should never try to cache the request
-	if request.Header.Get("Vary") == "*" {
+	if !c.policyFor(request).cache {
 		return nil, false
 	}
 
-	cached, ok := c.cacheMap[c.buildCacheKey(request)]
-	if !ok {
-		logger.Printf("[cache] Miss: %s... %s%s\n",
-			auth[0:10], request.Host, request.URL.String())
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := c.lookupKey(request)
+	cached, ok := c.cacheMap[key]
 
+	// with nothing to revalidate against, a negative entry is useless once
+	// it's no longer fresh
+	if ok && cached.negative && !cached.isFresh(time.Now()) {
+		c.remove(key)
+		if c.disk != nil {
+			c.disk.delete(key)
+		}
+		ok = false
+	}
+
+	if !ok || !cached.matchesVary(request) {
+		logger.Printf("[cache] Miss: %s %s%s\n",
+			fingerprintAuth(auth), request.Host, safeUrl(request.URL))
+
+		c.statsFor(canonicalHost(request.Host)).Misses++
 		return nil, false
 	}
 
-	logger.Printf("[cache] Hit: %s... %s%s [etag=%s]\n",
-		auth[0:10], request.Host, request.URL.String(), cached.etag)
+	logger.Printf("[cache] Hit: %s %s%s [etag=%s]\n",
+		fingerprintAuth(auth), request.Host, safeUrl(request.URL), cached.etag)
 
+	c.statsFor(canonicalHost(request.Host)).Hits++
+	c.lru.MoveToFront(cached.element)
 	return cached, true
 }
 
+// Adds an entry as the most recently used and evicts others as necessary to
+// bring the cache back under its limits. The caller must hold the mutex.
+func (c *RequestCache) add(key string, cached *CachedResponse) {
+	c.remove(key)
+
+	cached.key = key
+	cached.size = cachedSize(key, cached)
+	cached.element = c.lru.PushFront(cached)
+	c.cacheMap[key] = cached
+	c.size += cached.size - len(cached.content)
+	c.retainBody(cached)
+
+	// the most recent response decides which headers select a variant
+	record, ok := c.varyMap[cached.primaryKey]
+	if !ok {
+		record = &varyRecord{}
+		c.varyMap[cached.primaryKey] = record
+	}
+	record.count++
+	record.headers = cached.varyHeaders()
+
+	c.evict()
+}
+
+func (c *RequestCache) bodyCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.bodyMap)
+}
+
+func (c *RequestCache) bytes() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+// Negative entries can't be revalidated, so they're never served stale.
+func (c *RequestCache) canServeStale(cached *CachedResponse) bool {
+	if c.staleWhileRevalidate <= 0 || cached.negative {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !cached.mustRevalidate && cached.staleness(time.Now()) <= c.staleWhileRevalidate
+}
+
+func (c *RequestCache) canServeStaleOnError(request *http.Request, cached *CachedResponse) bool {
+	policy := c.policyFor(request).staleOnError
+	if !policy.enabled || cached.negative {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	staleness := cached.staleness(time.Now())
+	if staleness > 0 && cached.mustRevalidate {
+		return false
+	}
+
+	return policy.maxStale <= 0 || staleness <= policy.maxStale
+}
+
 func (c *RequestCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	numKeys := len(c.cacheMap)
 	for k := range c.cacheMap {
 		delete(c.cacheMap, k)
 	}
+	for k := range c.varyMap {
+		delete(c.varyMap, k)
+	}
+	for k := range c.bodyMap {
+		delete(c.bodyMap, k)
+	}
+	c.lru.Init()
+	c.size = 0
+	if c.disk != nil {
+		c.disk.clear()
+	}
 	logger.Printf("[cache] Cleared %v cache key(s)\n", numKeys)
 }
 
 func (c *RequestCache) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return len(c.cacheMap)
 }
 
+// Evicts least recently used entries until the cache is within both its byte
+// and count budgets. The caller must hold the mutex.
+func (c *RequestCache) evict() {
+	numEvicted := 0
+	for c.lru.Len() > 0 && (c.size > c.maxBytes || len(c.cacheMap) > c.maxCount) {
+		cached := c.lru.Back().Value.(*CachedResponse)
+		c.remove(cached.key)
+		if c.disk != nil {
+			c.disk.delete(cached.key)
+		}
+		c.statsFor(cached.host).Evictions++
+		numEvicted++
+	}
+
+	if numEvicted > 0 {
+		logger.Printf("[cache] Evicted %v cache key(s) [size=%v/%v] [count=%v/%v]\n",
+			numEvicted, c.size, c.maxBytes, len(c.cacheMap), c.maxCount)
+	}
+}
+
+func (c *RequestCache) load(disk *DiskStore) {
+	loaded, err := disk.load()
+	if err != nil {
+		fail(1, err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.disk = disk
+
+	// entries may have been persisted before the policy said not to, so
+	// they're checked against it again and kept only in memory if that's
+	// what it allows
+	numLoaded, numDropped := 0, 0
+	for k, v := range loaded {
+		policy := c.policyForPath(v.host, v.path)
+		if !policy.cache || !policy.persist {
+			disk.delete(k)
+			numDropped++
+		}
+		if policy.cache {
+			c.add(k, v)
+			numLoaded++
+		}
+	}
+
+	logger.Printf("[cache] Loaded %v cache key(s) from disk [unpersisted=%v]\n",
+		numLoaded, numDropped)
+}
+
 func (c *RequestCache) reap() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	numKeys := len(c.cacheMap)
 	now := time.Now()
 	expiredKeys := make([]string, 0)
@@ -170,36 +819,372 @@ func (c *RequestCache) reap() {
 		}
 	}
 
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
 	for _, k := range expiredKeys {
-		delete(c.cacheMap, k)
+		c.remove(k)
+		if c.disk != nil {
+			c.disk.delete(k)
+		}
 	}
 
 	logger.Printf("[cache] Reaped %v of %v cache key(s)\n",
 		len(expiredKeys), numKeys)
 }
 
-func (c *RequestCache) setCache(request *http.Request, headers http.Header, content []byte) {
+func (c *RequestCache) list() []CacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	entries := make([]CacheEntry, 0, len(c.cacheMap))
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		entries = append(entries, e.Value.(*CachedResponse).summarize(now))
+	}
+	return entries
+}
+
+// Removes every entry held for the same authorization and host whose path is
+// the request's path or one of its parents. For example, a request to
+// `/apps/foo/config-vars` invalidates `/apps/foo/config-vars`, `/apps/foo`
+// and `/apps`, along with any variants or query strings of each.
+//
+// Negative entries below the request's path are removed as well, because a
+// request like `POST /apps` may well have created what they say is missing.
+func (c *RequestCache) invalidate(request *http.Request) {
+	if request.Header.Get("Authorization") == "" {
+		return
+	}
+	auth := cacheIdentity(request.Header.Get("Authorization"))
+
+	host := canonicalHost(request.Host)
+	paths := make(map[string]bool)
+	for _, p := range parentPaths(request.URL.Path) {
+		paths[p] = true
+	}
+	childPrefix := strings.TrimSuffix(cleanPath(request.URL.Path), "/") + "/"
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	invalidatedKeys := make([]string, 0)
+	for k, v := range c.cacheMap {
+		if v.auth != auth || v.host != host {
+			continue
+		}
+		if paths[v.path] || (v.negative && strings.HasPrefix(v.path, childPrefix)) {
+			invalidatedKeys = append(invalidatedKeys, k)
+		}
+	}
+
+	for _, k := range invalidatedKeys {
+		c.remove(k)
+		if c.disk != nil {
+			c.disk.delete(k)
+		}
+	}
+
+	if len(invalidatedKeys) > 0 {
+		logger.Printf("[cache] Invalidated %v cache key(s) after %s %s%s\n",
+			len(invalidatedKeys), request.Method, request.Host, request.URL.Path)
+	}
+}
+
+func (c *RequestCache) finishRevalidation(cached *CachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached.revalidating = false
+}
+
+// Like CachedResponse.staleness, but for callers that don't hold the mutex.
+func (c *RequestCache) staleness(cached *CachedResponse) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return cached.staleness(time.Now())
+}
+
+// Like lookupKey, but for callers outside the cache that don't hold the mutex.
+func (c *RequestCache) variantKey(request *http.Request) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lookupKey(request)
+}
+
+// Whether an entry can be served without revalidation, either because the
+// API said that it's fresh or because it's within a configured fresh window.
+func (c *RequestCache) isFresh(request *http.Request, cached *CachedResponse) bool {
+	window := c.policyFor(request).freshWindow
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if cached.isFresh(now) {
+		return true
+	}
+	return window > 0 && now.Sub(cached.validatedAt) < window
+}
+
+// Finds the key under which the variant of a resource that matches the
+// request would be stored, based on the `Vary` of the last response seen for
+// it. The caller must hold the mutex.
+func (c *RequestCache) lookupKey(request *http.Request) string {
+	primaryKey := c.buildCacheKey(request)
+
+	var headers []string
+	if record, ok := c.varyMap[primaryKey]; ok {
+		headers = record.headers
+	}
+
+	return c.buildVariantKey(primaryKey, headers, request)
+}
+
+func (c *RequestCache) purge(args CachePurgeArgs) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	host := canonicalHost(args.Host)
+	purgedKeys := make([]string, 0)
+
+	for k, v := range c.cacheMap {
+		if host != "" && v.host != host {
+			continue
+		}
+		if args.PathPrefix != "" && !strings.HasPrefix(v.path, args.PathPrefix) {
+			continue
+		}
+		if args.OlderThan > 0 && now.Sub(v.validatedAt) < args.OlderThan {
+			continue
+		}
+		purgedKeys = append(purgedKeys, k)
+	}
+
+	for _, k := range purgedKeys {
+		c.remove(k)
+		if c.disk != nil {
+			c.disk.delete(k)
+		}
+	}
+
+	logger.Printf("[cache] Purged %v of %v cache key(s)\n",
+		len(purgedKeys), len(purgedKeys)+len(c.cacheMap))
+	return len(purgedKeys)
+}
+
+// Updates an entry's freshness from the headers of a 304 that confirmed it's
+// still current, along with its copy on disk so that it lasts as long after a
+// restart as it would have in memory.
+//
+// As described by RFC 7234, the stored directives are only replaced if the
+// 304 carries its own. Otherwise the entry keeps its `must-revalidate` and is
+// fresh for as long again as it was when it was stored.
+func (c *RequestCache) refresh(cached *CachedResponse, headers http.Header) {
+	cc := parseCacheability(headers)
+	hasDirectives := headers.Get("Cache-Control") != "" || headers.Get("Expires") != ""
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !hasDirectives {
+		cc.mustRevalidate = cached.mustRevalidate
+		if lifetime := cached.freshUntil.Sub(cached.validatedAt); lifetime > 0 {
+			cc.freshUntil = now.Add(lifetime)
+		}
+	}
+	cached.freshUntil = cc.freshUntil
+	cached.mustRevalidate = cc.mustRevalidate
+	cached.expiresAt = cc.expiresAt()
+	cached.validatedAt = now
+
+	stats := c.statsFor(cached.host)
+	stats.NotModified++
+	stats.BytesSaved += int64(len(cached.content))
+
+	// the entry may have been removed while it was being revalidated, in
+	// which case it mustn't come back on disk either
+	if c.disk != nil && c.cacheMap[cached.key] == cached &&
+		c.policyForPath(cached.host, cached.path).persist {
+		c.disk.save(cached.key, cached)
+	}
+}
+
+// Removes an entry from the map and the LRU list, if it exists. The caller
+// must hold the mutex.
+func (c *RequestCache) remove(key string) {
+	cached, ok := c.cacheMap[key]
+	if !ok {
+		return
+	}
+
+	c.lru.Remove(cached.element)
+	delete(c.cacheMap, key)
+	c.size -= cached.size - len(cached.content)
+	c.releaseBody(cached)
+
+	record, ok := c.varyMap[cached.primaryKey]
+	if ok {
+		record.count--
+		if record.count <= 0 {
+			delete(c.varyMap, cached.primaryKey)
+		}
+	}
+}
+
+// Drops an entry's reference to its body, and the body itself along with its
+// share of the cache's size if nothing else refers to it. The caller must
+// hold the mutex.
+func (c *RequestCache) releaseBody(cached *CachedResponse) {
+	body, ok := c.bodyMap[cached.digest]
+	if !ok {
+		return
+	}
+
+	body.refs--
+	if body.refs <= 0 {
+		delete(c.bodyMap, cached.digest)
+		c.size -= len(body.content)
+	}
+}
+
+// Points an entry at the stored copy of its body, storing it first if no
+// other entry has the same content so that only the first copy counts toward
+// the cache's size. The caller must hold the mutex.
+func (c *RequestCache) retainBody(cached *CachedResponse) {
+	if cached.digest == "" {
+		cached.digest = contentDigest(cached.content)
+	}
+
+	body, ok := c.bodyMap[cached.digest]
+	if !ok {
+		body = &cachedBody{content: cached.content}
+		c.bodyMap[cached.digest] = body
+		c.size += len(body.content)
+	}
+
+	body.refs++
+	cached.content = body.content
+}
+
+// Marks an entry as being revalidated in the background, returning false if
+// it already was so that only one revalidation is in flight at a time.
+func (c *RequestCache) startRevalidation(cached *CachedResponse) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cached.revalidating {
+		return false
+	}
+	cached.revalidating = true
+	return true
+}
+
+// Finds an entry by its ID, or by a prefix of its ID as long as only one
+// entry matches.
+func (c *RequestCache) show(id string) (*CacheEntryDetail, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var found *CachedResponse
+	for k, v := range c.cacheMap {
+		if !strings.HasPrefix(cacheEntryId(k), id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one entry matches %s", id)
+		}
+		found = v
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no entry matches %s", id)
+	}
+
+	return &CacheEntryDetail{
+		CacheEntry: found.summarize(time.Now()),
+		Content:    found.content,
+		FreshUntil: found.freshUntil,
+		Header:     found.header,
+		Status:     found.statusCode(),
+		Vary:       found.vary,
+	}, nil
+}
+
+func (c *RequestCache) setCache(request *http.Request, status int, headers http.Header, content []byte) {
+	if request.Method != "GET" {
+		return
+	}
+
+	// a 206 is what list endpoints respond with when there are more pages,
+	// and a 404 or 410 is only kept if negative caching is enabled
+	negative := status == 404 || status == 410
+	if status != 200 && status != 206 && !(negative && c.negativeTtl > 0) {
+		return
+	}
+
 	auth := request.Header.Get("Authorization")
 	if auth == "" {
 		return
 	}
 
+	// A response that must not be stored also means that whatever we may
+	// have been holding for the same request shouldn't be used anymore. The
+	// same goes for `Vary: *`, which says that no request can be known to
+	// match the response, and for a policy that disables caching.
+	policy := c.policyFor(request)
+	cc := parseCacheability(headers)
+	varyHeaders, varyAll := parseVary(headers)
+	if cc.noStore || varyAll || !policy.cache {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		key := c.lookupKey(request)
+		c.remove(key)
+		if c.disk != nil {
+			c.disk.delete(key)
+		}
+		logger.Printf("[cache] Not storing: %s %s%s [uncacheable]\n",
+			fingerprintAuth(auth), request.Host, safeUrl(request.URL))
+		return
+	}
+
+	// without a validator there'd be no way to revalidate the entry, which
+	// is only acceptable for negative entries that are never revalidated
 	etag := headers.Get("Etag")
-	if etag == "" {
+	lastModified := headers.Get("Last-Modified")
+	if etag == "" && lastModified == "" && !negative {
 		return
 	}
 
-	url := request.URL.String()
+	url := safeUrl(request.URL)
 	cached := &CachedResponse{
-		content:   content,
-		expiresAt: time.Now().Add(60 * time.Minute),
-		header:    make(http.Header),
-		etag:      etag,
+		auth:           cacheIdentity(auth),
+		content:        content,
+		digest:         contentDigest(content),
+		expiresAt:      cc.expiresAt(),
+		fingerprint:    fingerprintAuth(auth),
+		freshUntil:     cc.freshUntil,
+		header:         make(http.Header),
+		host:           canonicalHost(request.Host),
+		etag:           etag,
+		lastModified:   lastModified,
+		mustRevalidate: cc.mustRevalidate,
+		path:           cleanPath(request.URL.Path),
+		status:         status,
+		url:            url,
+		primaryKey:     c.buildCacheKey(request),
+		validatedAt:    time.Now(),
+		vary:           make(map[string]string),
 	}
 
-	// store Content-* headers for an accurate cached response
+	if negative {
+		cached.negative = true
+		cached.freshUntil = cached.validatedAt.Add(c.negativeTtl)
+		cached.expiresAt = cached.freshUntil
+	}
+
+	for _, h := range varyHeaders {
+		cached.vary[h] = request.Header.Get(h)
+	}
+	key := c.buildVariantKey(cached.primaryKey, varyHeaders, request)
+
+	// store Content-* and pagination headers for an accurate cached response
 	for h, vs := range headers {
 		for _, v := range vs {
 			if _, ok := contentHeaders[h]; ok {
@@ -210,8 +1195,313 @@ func (c *RequestCache) setCache(request *http.Request, headers http.Header, cont
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.cacheMap[c.buildCacheKey(request)] = cached
+	c.add(key, cached)
+	c.statsFor(canonicalHost(request.Host)).Stores++
+
+	// the budget may have been so small that the new entry was evicted
+	// immediately, in which case there's nothing to persist
+	if _, ok := c.cacheMap[key]; !ok {
+		return
+	}
+
+	if negative {
+		logger.Printf("[cache] Store negative: %s %s%s [status=%v] [ttl=%v]\n",
+			fingerprintAuth(auth), request.Host, url, status, c.negativeTtl)
+	} else {
+		logger.Printf("[cache] Store: %s %s%s [etag=%s]\n",
+			fingerprintAuth(auth), request.Host, url, etag)
+	}
+
+	if c.disk == nil {
+		return
+	}
+
+	// an older response for the same key may have been persisted before the
+	// policy changed, so make sure that it's gone
+	if !policy.persist {
+		c.disk.delete(key)
+		return
+	}
+
+	c.disk.save(key, cached)
+}
+
+func (c *CachedResponse) isFresh(now time.Time) bool {
+	return now.Before(c.freshUntil)
+}
+
+// How long the entry has been stale for. Entries without freshness information
+// go stale as soon as they've been validated.
+func (c *CachedResponse) staleness(now time.Time) time.Duration {
+	freshUntil := c.freshUntil
+	if freshUntil.Before(c.validatedAt) {
+		freshUntil = c.validatedAt
+	}
+	return now.Sub(freshUntil)
+}
+
+func (c *CachedResponse) summarize(now time.Time) CacheEntry {
+	return CacheEntry{
+		Age:          now.Sub(c.validatedAt),
+		Auth:         c.fingerprint,
+		Etag:         c.etag,
+		LastModified: c.lastModified,
+		ExpiresAt:    c.expiresAt,
+		Host:         c.host,
+		Id:           cacheEntryId(c.key),
+		Size:         c.size,
+		Url:          c.url,
+	}
+}
+
+// Makes a request conditional on this entry, preferring its etag over its
+// modification time. A negative entry has no validators, so a request for one
+// is left unconditional.
+func (c *CachedResponse) setConditionalHeaders(r *http.Request) {
+	if c.etag != "" {
+		r.Header.Set("If-None-Match", c.etag)
+	} else if c.lastModified != "" {
+		r.Header.Set("If-Modified-Since", c.lastModified)
+	}
+}
+
+func (c *CachedResponse) statusCode() int {
+	if c.status == 0 {
+		return 200
+	}
+	return c.status
+}
+
+func (c *CachedResponse) matchesVary(request *http.Request) bool {
+	for h, v := range c.vary {
+		if request.Header.Get(h) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CachedResponse) varyHeaders() []string {
+	headers := make([]string, 0, len(c.vary))
+	for h := range c.vary {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// Entries are kept at least long enough to be useful for revalidation, and
+// longer if the response said that it would stay fresh for longer.
+func (cc *cacheability) expiresAt() time.Time {
+	expiresAt := time.Now().Add(CacheRetention)
+	if cc.freshUntil.After(expiresAt) {
+		expiresAt = cc.freshUntil
+	}
+	return expiresAt
+}
+
+// Produces a short handle for an entry that can be typed on the command line
+// without exposing the authorization that's part of its key.
+func cacheEntryId(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[0:12]
+}
+
+// Identifies a body by its content.
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Approximates the memory held by an entry: its body along with its key and
+// every string stored alongside it. A body that's shared with other entries
+// is counted here for each of them, but only once by the cache as a whole.
+func cachedSize(key string, cached *CachedResponse) int {
+	size := len(key) + len(cached.primaryKey) + len(cached.content) +
+		len(cached.etag) + len(cached.lastModified) + len(cached.auth) + len(cached.host) + len(cached.path) +
+		len(cached.url) + len(cached.fingerprint)
+	for h, vs := range cached.header {
+		for _, v := range vs {
+			size += len(h) + len(v)
+		}
+	}
+	for h, v := range cached.vary {
+		size += len(h) + len(v)
+	}
+	return size
+}
+
+// Lowercases a host and strips the HTTPS port, which is the default for the
+// API. Port 80 is left alone because it's what makes ProxyHandler use plain
+// HTTP, so it changes where the request goes.
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ":443")
+}
+
+// Removes whitespace around the separators of a header value like
+// `application/vnd.heroku+json; version=3` or `id ..; max=10`, and collapses
+// any other runs of whitespace into a single space.
+func canonicalHeaderValue(v string) string {
+	v = strings.Join(strings.Fields(v), " ")
+	for _, sep := range []string{",", ";", "="} {
+		v = strings.Replace(v, " "+sep, sep, -1)
+		v = strings.Replace(v, sep+" ", sep, -1)
+	}
+	return v
+}
+
+// Produces the path and query of a URL with query parameters sorted by name.
+// The values of a repeated parameter keep their order because it may be
+// significant. The path keeps its escaping so that an escaped slash isn't
+// mistaken for a separator.
+func canonicalUrl(u *url.URL) string {
+	canonical := &url.URL{
+		Path:     u.Path,
+		RawPath:  u.EscapedPath(),
+		RawQuery: u.Query().Encode(),
+	}
+	return canonical.String()
+}
+
+func cleanPath(p string) string {
+	p = strings.TrimSuffix(p, "/")
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// Returns a path along with each of its parents, not including the root.
+func parentPaths(p string) []string {
+	paths := make([]string, 0)
+	for p = cleanPath(p); p != "/"; p = cleanPath(path.Dir(p)) {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// Interprets the caching directives of a response.
+//
+// Note that `private` is deliberately allowed: it forbids storage in shared
+// caches, but every entry that heroku-agent holds is scoped to the
+// authorization that requested it. `s-maxage` and `proxy-revalidate` are
+// ignored for the same reason.
+func parseCacheability(headers http.Header) *cacheability {
+	cc := &cacheability{}
+	directives := parseCacheControl(headers.Get("Cache-Control"))
+
+	if _, ok := directives["no-store"]; ok {
+		cc.noStore = true
+		return cc
+	}
+
+	if _, ok := directives["must-revalidate"]; ok {
+		cc.mustRevalidate = true
+	}
+
+	// `no-cache` means that a stored response must always be revalidated,
+	// which is what we'd do anyway without freshness information
+	if _, ok := directives["no-cache"]; ok {
+		return cc
+	}
+
+	now := time.Now()
+
+	if maxAge, ok := directives["max-age"]; ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return cc
+		}
+
+		// account for time that the response already spent in upstream
+		// caches
+		age, _ := strconv.Atoi(headers.Get("Age"))
+
+		cc.freshUntil = now.Add(time.Duration(seconds-age) * time.Second)
+		return cc
+	}
+
+	if expires := headers.Get("Expires"); expires != "" {
+		// an invalid date (commonly "0") means already expired
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return cc
+		}
+
+		// measure the lifetime against the server's clock rather than ours
+		// where possible in case the two are skewed
+		if date, err := http.ParseTime(headers.Get("Date")); err == nil {
+			cc.freshUntil = now.Add(expiresAt.Sub(date))
+		} else {
+			cc.freshUntil = expiresAt
+		}
+	}
+
+	return cc
+}
+
+// Breaks a `Cache-Control` header into its directives. Directive names are
+// lowercased and any quotes around values are removed.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value := part, ""
+		if i := strings.Index(part, "="); i != -1 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return directives
+}
+
+// Parses a stale-on-error policy, which is one of "off", "always", or a
+// duration like "1h" that's the most that an entry may be stale by.
+func parseStaleOnError(s string) (staleOnErrorPolicy, error) {
+	switch s {
+	case "off":
+		return staleOnErrorPolicy{}, nil
+	case "always":
+		return staleOnErrorPolicy{enabled: true}, nil
+	}
+
+	maxStale, err := time.ParseDuration(s)
+	if err != nil {
+		return staleOnErrorPolicy{}, err
+	}
+	if maxStale <= 0 {
+		return staleOnErrorPolicy{}, fmt.Errorf("duration must be positive")
+	}
+
+	return staleOnErrorPolicy{enabled: true, maxStale: maxStale}, nil
+}
+
+// Returns the canonicalized, sorted names of the request headers that a
+// response varies on, and whether it varies on `*`.
+func parseVary(headers http.Header) ([]string, bool) {
+	seen := make(map[string]bool)
+	varyHeaders := make([]string, 0)
+
+	for _, v := range headers[http.CanonicalHeaderKey("Vary")] {
+		for _, h := range strings.Split(v, ",") {
+			h = strings.TrimSpace(h)
+			if h == "*" {
+				return nil, true
+			}
+
+			h = http.CanonicalHeaderKey(h)
+			if h == "" || seen[h] {
+				continue
+			}
+			seen[h] = true
+			varyHeaders = append(varyHeaders, h)
+		}
+	}
 
-	logger.Printf("[cache] Store: %s... %s%s [etag=%s]\n",
-		auth[0:10], request.Host, url, etag)
+	sort.Strings(varyHeaders)
+	return varyHeaders, false
 }
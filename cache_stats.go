@@ -0,0 +1,58 @@
+package main
+
+// Counts how effective the cache has been for requests to a single host.
+type CacheStats struct {
+	// Bytes that weren't transferred because the API responded with a 304
+	// and the body was served from cache instead.
+	BytesSaved int64
+
+	Evictions      int
+	Hits           int
+	Misses         int
+	NotModified    int
+	StaleFallbacks int
+	Stores         int
+}
+
+// Returns a copy of the statistics for every host that the cache has seen.
+func CacheStatsByHost() map[string]CacheStats {
+	return cache.statsByHost()
+}
+
+func (s *CacheStats) add(other CacheStats) {
+	s.BytesSaved += other.BytesSaved
+	s.Evictions += other.Evictions
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.NotModified += other.NotModified
+	s.StaleFallbacks += other.StaleFallbacks
+	s.Stores += other.Stores
+}
+
+func (c *RequestCache) recordStats(host string, update func(s *CacheStats)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	update(c.statsFor(host))
+}
+
+func (c *RequestCache) statsByHost() map[string]CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := make(map[string]CacheStats, len(c.statsMap))
+	for host, s := range c.statsMap {
+		stats[host] = *s
+	}
+	return stats
+}
+
+// Returns the statistics for a host, creating them if necessary. The caller
+// must hold the mutex.
+func (c *RequestCache) statsFor(host string) *CacheStats {
+	s, ok := c.statsMap[host]
+	if !ok {
+		s = &CacheStats{}
+		c.statsMap[host] = s
+	}
+	return s
+}
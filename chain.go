@@ -10,6 +10,24 @@ type HandlerFunc func(r *http.Request, next NextHandlerFunc) (*httptest.Response
 type NextHandlerFunc func(r *http.Request) (*httptest.ResponseRecorder, error)
 
 func BuildHandlerChain(handlers []HandlerFunc) func(w http.ResponseWriter, r *http.Request) {
+	chain := buildChain(handlers)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder, err := chain(r)
+		// the ErrorHandler should always swallow errors before we get here, so
+		// this panic should never happen
+		if err != nil {
+			logger.Panic(err)
+		}
+		copyHeaders(recorder.Header(), w.Header())
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}
+}
+
+// Composes handlers into a single function that can also be invoked directly
+// for requests that originate within the agent itself.
+func buildChain(handlers []HandlerFunc) NextHandlerFunc {
 	chain := func(_ *http.Request) (*httptest.ResponseRecorder, error) {
 		return httptest.NewRecorder(), nil
 	}
@@ -23,15 +41,5 @@ func BuildHandlerChain(handlers []HandlerFunc) func(w http.ResponseWriter, r *ht
 		}
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		recorder, err := chain(r)
-		// the ErrorHandler should always swallow errors before we get here, so
-		// this panic should never happen
-		if err != nil {
-			logger.Panic(err)
-		}
-		copyHeaders(recorder.Header(), w.Header())
-		w.WriteHeader(recorder.Code)
-		w.Write(recorder.Body.Bytes())
-	}
+	return chain
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+var (
+	coalescer *RequestCoalescer
+)
+
+// Tracks an upstream request that's in progress so that identical requests
+// arriving in the meantime can wait for its result instead of making their
+// own.
+type inFlightRequest struct {
+	done chan struct{}
+	err  error
+	w    *httptest.ResponseRecorder
+}
+
+type RequestCoalescer struct {
+	inFlightMap map[string]*inFlightRequest
+	mutex       *sync.Mutex
+}
+
+func init() {
+	coalescer = &RequestCoalescer{
+		inFlightMap: make(map[string]*inFlightRequest),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func CoalesceHandler(r *http.Request, next NextHandlerFunc) (*httptest.ResponseRecorder, error) {
+	// only GETs are safe to share, and only those that we'd consider caching
+	// have a key that identifies them
+	if r.Method != "GET" || r.Header.Get("Authorization") == "" {
+		return next(r)
+	}
+
+	// requests conditional on different validators may get different
+	// responses, so they can't be shared
+	key := cache.variantKey(r) + "|" + r.Header.Get("If-None-Match") + "|" +
+		r.Header.Get("If-Modified-Since")
+
+	coalescer.mutex.Lock()
+	inFlight, ok := coalescer.inFlightMap[key]
+	if ok {
+		coalescer.mutex.Unlock()
+
+		logger.Printf("[coalesce] Waiting on in-flight request: %s%s\n",
+			r.Host, safeUrl(r.URL))
+		<-inFlight.done
+		return copyRecorder(inFlight.w), inFlight.err
+	}
+
+	inFlight = &inFlightRequest{done: make(chan struct{})}
+	coalescer.inFlightMap[key] = inFlight
+	coalescer.mutex.Unlock()
+
+	inFlight.w, inFlight.err = next(r)
+
+	coalescer.mutex.Lock()
+	delete(coalescer.inFlightMap, key)
+	coalescer.mutex.Unlock()
+	close(inFlight.done)
+
+	// handlers further up the chain modify the response they get back, so
+	// even this caller gets a copy to leave the original intact for others
+	return copyRecorder(inFlight.w), inFlight.err
+}
+
+func copyRecorder(w *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	if w == nil {
+		return nil
+	}
+
+	newWriter := httptest.NewRecorder()
+	for h, vs := range w.Header() {
+		newWriter.Header()[h] = append([]string(nil), vs...)
+	}
+	newWriter.WriteHeader(w.Code)
+	if w.Body != nil {
+		newWriter.Write(w.Body.Bytes())
+	}
+	return newWriter
+}
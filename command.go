@@ -2,13 +2,22 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/rpc"
 	"os"
+	"sort"
+	"text/tabwriter"
 	"time"
+
+	flag "github.com/ogier/pflag"
 )
 
 func RunCommand(command string, args []string) {
 	switch {
+	case command == "2fa":
+		twoFactor(args)
+	case command == "cache" && len(args) >= 1:
+		cacheCommand(args[0], args[1:])
 	case command == "clear":
 		clear()
 	case command == "help":
@@ -17,6 +26,8 @@ func RunCommand(command string, args []string) {
 		stats()
 	case command == "stop":
 		stop()
+	case command == "totp" && len(args) <= 1:
+		totp(args)
 	case command == "upgrade-token" && len(args) == 1:
 		upgradeToken(args[0])
 	case command == "version":
@@ -27,6 +38,75 @@ func RunCommand(command string, args []string) {
 	}
 }
 
+func cacheCommand(subcommand string, args []string) {
+	switch {
+	case subcommand == "list" && len(args) == 0:
+		cacheList()
+	case subcommand == "purge":
+		cachePurge(args)
+	case subcommand == "show" && len(args) == 1:
+		cacheShow(args[0])
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+func cacheList() {
+	entries := []CacheEntry{}
+	call("CacheList", []string{}, &entries)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tAUTH\tHOST\tURL\tETAG\tSIZE\tAGE\tEXPIRES\n")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%v\t%v\n",
+			e.Id, e.Auth, e.Host, e.Url, e.Etag, e.Size,
+			roundDuration(e.Age), roundDuration(e.ExpiresAt.Sub(time.Now())))
+	}
+	w.Flush()
+}
+
+func cachePurge(args []string) {
+	purgeArgs := CachePurgeArgs{}
+
+	flags := flag.NewFlagSet("cache purge", flag.ContinueOnError)
+	flags.StringVar(&purgeArgs.Host, "host", "", "Only purge entries for this host")
+	flags.DurationVar(&purgeArgs.OlderThan, "older-than", 0,
+		"Only purge entries last validated longer ago than this")
+	flags.StringVar(&purgeArgs.PathPrefix, "path-prefix", "",
+		"Only purge entries whose path starts with this")
+	if err := flags.Parse(args); err != nil || len(flags.Args()) > 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	count := 0
+	call("CachePurge", purgeArgs, &count)
+	fmt.Printf("Purged %v cache entries\n", count)
+}
+
+func cacheShow(id string) {
+	entry := &CacheEntryDetail{}
+	call("CacheShow", id, entry)
+
+	fmt.Printf("ID: %s\n", entry.Id)
+	fmt.Printf("Auth: %s\n", entry.Auth)
+	fmt.Printf("URL: %s%s\n", entry.Host, entry.Url)
+	fmt.Printf("Status: %v\n", entry.Status)
+	fmt.Printf("Etag: %s\n", entry.Etag)
+	fmt.Printf("Last modified: %s\n", entry.LastModified)
+	fmt.Printf("Size: %v\n", entry.Size)
+	fmt.Printf("Age: %v\n", roundDuration(entry.Age))
+	fmt.Printf("Fresh until: %v\n", entry.FreshUntil)
+	fmt.Printf("Expires at: %v\n", entry.ExpiresAt)
+	for h, v := range entry.Vary {
+		fmt.Printf("Vary: %s: %s\n", h, v)
+	}
+	fmt.Printf("\n")
+	entry.Header.Write(os.Stdout)
+	fmt.Printf("\n%s\n", entry.Content)
+}
+
 func call(method string, args interface{}, reply interface{}) {
 	client := getClient()
 
@@ -64,10 +144,19 @@ Runs as daemon unless [command] is specified.
 
 Commands:
 
+    2fa            List requests held by daemon waiting for a second factor
+    2fa CODE       Supply a second factor for held requests; choose which
+                   with --id if more than one authorization is waiting
+    cache list     List entries in daemon's cache
+    cache purge    Purge entries from daemon's cache; filter with --host,
+                   --path-prefix, or --older-than
+    cache show ID  Display an entry in daemon's cache, including its body
     clear          Clear daemon's cache and two factor store
     help           Display help text
     state          Display daemon's state
     stop           Stop daemon
+    totp [CODE]    Display codes generated from the TOTP secret, or check
+                   that CODE is among them
     upgrade-token  Exchange token for 2FA-privileged token, if one is held
     version        Display version
 `)
@@ -82,12 +171,47 @@ func logStart(method string) {
 	logger.Printf("[command] Request: RPC: %s [start]\n", method)
 }
 
+func printCacheStats(w io.Writer, host string, s CacheStats) {
+	fmt.Fprintf(w, "%s\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", host, s.Hits, s.Misses,
+		s.NotModified, s.StaleFallbacks, s.Stores, s.Evictions, s.BytesSaved)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d / time.Second * time.Second
+}
+
 func stats() {
 	state := &State{}
 	call("GetState", []string{}, state)
-	fmt.Printf("Cache count: %v\n", state.CacheCount)
+	fmt.Printf("Cache count: %v (limit %v)\n", state.CacheCount, state.CacheMaxCount)
+	fmt.Printf("Cache size: %v bytes (limit %v)\n", state.CacheBytes, state.CacheMaxBytes)
+	fmt.Printf("Cache bodies: %v distinct\n", state.CacheBodies)
 	fmt.Printf("Second factor count: %v\n", state.TwoFactorCount)
 	fmt.Printf("Up: %v\n", time.Now().Sub(state.UpAt))
+
+	if len(state.CacheStats) == 0 {
+		return
+	}
+
+	hosts := make([]string, 0, len(state.CacheStats))
+	for host := range state.CacheStats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	total := CacheStats{}
+	fmt.Printf("\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "HOST\tHITS\tMISSES\t304S\tSTALE\tSTORES\tEVICTIONS\tBYTES SAVED\n")
+	for _, host := range hosts {
+		s := state.CacheStats[host]
+		total.add(s)
+		printCacheStats(w, host, s)
+	}
+	if len(hosts) > 1 {
+		printCacheStats(w, "(total)", total)
+	}
+	w.Flush()
 }
 
 func stop() {
@@ -95,6 +219,74 @@ func stop() {
 	fmt.Printf("Stopped\n")
 }
 
+func twoFactor(args []string) {
+	codeArgs := TwoFactorCodeArgs{}
+
+	flags := flag.NewFlagSet("2fa", flag.ContinueOnError)
+	flags.StringVar(&codeArgs.Id, "id", "", "Supply the code for this request")
+	if err := flags.Parse(args); err != nil || len(flags.Args()) > 1 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	if len(flags.Args()) == 0 {
+		twoFactorPending()
+		return
+	}
+
+	codeArgs.Code = flags.Arg(0)
+	count := 0
+	call("TwoFactorCode", codeArgs, &count)
+	fmt.Printf("Resumed %v requests\n", count)
+}
+
+func twoFactorPending() {
+	pending := []PendingRequest{}
+	call("TwoFactorPending", []string{}, &pending)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tAUTH\tMETHOD\tHOST\tURL\tWAITING\n")
+	for _, p := range pending {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\n",
+			p.Id, p.Auth, p.Method, p.Host, p.Url,
+			roundDuration(time.Now().Sub(p.ParkedAt)))
+	}
+	w.Flush()
+}
+
+// Shows the codes that the daemon would generate so that they can be compared
+// to those of an authenticator app. This reads the secret itself rather than
+// asking the daemon so that it can be checked before the daemon is started.
+func totp(args []string) {
+	path := getTotpSecretPath()
+	if path == "" {
+		fail(1, fmt.Errorf("HEROKU_AGENT_TOTP_SECRET_FILE is not set"))
+	}
+
+	secret, err := loadTotpSecret(path)
+	if err != nil {
+		fail(1, err)
+	}
+
+	now := time.Now()
+	previous := totpCode(secret, now.Add(-TotpPeriod))
+	current := totpCode(secret, now)
+	next := totpCode(secret, now.Add(TotpPeriod))
+
+	if len(args) == 0 {
+		fmt.Printf("Current code: %s (valid for %v)\n", current, totpRemaining(now))
+		fmt.Printf("Next code: %s\n", next)
+		return
+	}
+
+	// allow a step either way in case of a little clock skew
+	if args[0] != previous && args[0] != current && args[0] != next {
+		fmt.Printf("Code %s does not match; check the secret and this machine's clock\n", args[0])
+		os.Exit(1)
+	}
+	fmt.Printf("Code %s matches\n", args[0])
+}
+
 func upgradeToken(token string) {
 	upgradedToken := ""
 	call("UpgradeToken", token, &upgradedToken)
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	UsageFileName = "usage"
+)
+
+// DiskStore persists cached responses to a directory so that they survive a
+// restart of the daemon. Every entry is encrypted because its body is
+// sensitive, and so are the headers needed to replay requests when warming.
+type DiskStore struct {
+	aead    cipher.AEAD
+	dir     string
+	nameKey []byte
+
+	// Saves, deletes, and clears are queued by the cache while it holds its
+	// lock and made by a background writer afterward, so that no request
+	// waits on disk. Only the latest write queued for each key is made, and
+	// a nil entry means that the key is to be deleted.
+	flushMutex   *sync.Mutex
+	mutex        *sync.Mutex
+	pendingClear bool
+	pendingMap   map[string]*diskEntry
+	wake         chan bool
+}
+
+// The on-disk representation of a cached response. This is serialized to JSON
+// and then encrypted as a whole.
+type diskEntry struct {
+	Auth           string            `json:"auth"`
+	Content        []byte            `json:"content"`
+	Etag           string            `json:"etag"`
+	ExpiresAt      time.Time         `json:"expires_at"`
+	Fingerprint    string            `json:"fingerprint"`
+	FreshUntil     time.Time         `json:"fresh_until"`
+	Header         http.Header       `json:"header"`
+	Host           string            `json:"host"`
+	Key            string            `json:"key"`
+	LastModified   string            `json:"last_modified"`
+	MustRevalidate bool              `json:"must_revalidate"`
+	Negative       bool              `json:"negative"`
+	Path           string            `json:"path"`
+	PrimaryKey     string            `json:"primary_key"`
+	Status         int               `json:"status"`
+	Url            string            `json:"url"`
+	ValidatedAt    time.Time         `json:"validated_at"`
+	Vary           map[string]string `json:"vary"`
+}
+
+// Initializes a store at the given directory. If a secret is provided, keys
+// are derived from it so that entries can be read back by a future daemon.
+// Otherwise keys are generated randomly and are held only by this process,
+// which means that entries written by a previous daemon are unreadable and
+// will be discarded on load.
+func NewDiskStore(dir string, secret string) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// MkdirAll won't touch the permissions of a directory that already
+	// exists, so make sure that only the current user can read it
+	err = os.Chmod(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptionKey, err := deriveKey(secret, "heroku-agent cache encryption")
+	if err != nil {
+		return nil, err
+	}
+
+	nameKey, err := deriveKey(secret, "heroku-agent cache names")
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskStore{
+		aead:       aead,
+		dir:        dir,
+		flushMutex: &sync.Mutex{},
+		mutex:      &sync.Mutex{},
+		nameKey:    nameKey,
+		pendingMap: make(map[string]*diskEntry),
+		wake:       make(chan bool, 1),
+	}, nil
+}
+
+// Queues the removal of everything in the store, superseding any writes that
+// are still queued.
+func (d *DiskStore) clear() {
+	d.mutex.Lock()
+	d.pendingClear = true
+	d.pendingMap = make(map[string]*diskEntry)
+	d.mutex.Unlock()
+	d.notify()
+}
+
+func (d *DiskStore) delete(key string) {
+	d.queue(key, nil)
+}
+
+// Makes every queued write. This is what the background writer does whenever
+// there are writes waiting, and it's also called on stop so that none are
+// lost.
+func (d *DiskStore) flush() {
+	d.flushMutex.Lock()
+	defer d.flushMutex.Unlock()
+
+	d.mutex.Lock()
+	pendingClear := d.pendingClear
+	pendingMap := d.pendingMap
+	d.pendingClear = false
+	d.pendingMap = make(map[string]*diskEntry)
+	d.mutex.Unlock()
+
+	if pendingClear {
+		d.removeAll()
+	}
+
+	for key, entry := range pendingMap {
+		if entry == nil {
+			d.remove(key)
+			continue
+		}
+
+		err := d.write(d.path(key), entry)
+		if err != nil {
+			logger.Printf("[disk] Error persisting: %s\n", err.Error())
+		}
+	}
+}
+
+// Removes the files that the store wrote, and only those, in case the cache
+// directory is shared with anything else.
+func (d *DiskStore) removeAll() {
+	paths, err := d.entryPaths()
+	if err != nil {
+		logger.Printf("[disk] Error clearing: %s\n", err.Error())
+		return
+	}
+
+	tempPaths, err := filepath.Glob(filepath.Join(d.dir, ".tmp-*"))
+	if err != nil {
+		logger.Printf("[disk] Error clearing: %s\n", err.Error())
+		return
+	}
+	paths = append(paths, tempPaths...)
+
+	numRemoved := 0
+	for _, path := range append(paths, filepath.Join(d.dir, UsageFileName)) {
+		if os.Remove(path) == nil {
+			numRemoved++
+		}
+	}
+	logger.Printf("[disk] Cleared %v file(s)\n", numRemoved)
+}
+
+func (d *DiskStore) remove(key string) {
+	err := os.Remove(d.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("[disk] Error deleting: %s\n", err.Error())
+	}
+}
+
+// Reads every entry back from disk. Entries that have expired or that can't be
+// decrypted with the current key are removed as they're found.
+func (d *DiskStore) load() (map[string]*CachedResponse, error) {
+	paths, err := d.entryPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	loaded := make(map[string]*CachedResponse)
+
+	for _, path := range paths {
+		entry := &diskEntry{}
+		err := d.read(path, entry)
+		if err != nil {
+			logger.Printf("[disk] Discarding unreadable file %s: %s\n",
+				filepath.Base(path), err.Error())
+			os.Remove(path)
+			continue
+		}
+
+		if now.After(entry.ExpiresAt) {
+			os.Remove(path)
+			continue
+		}
+
+		loaded[entry.Key] = &CachedResponse{
+			auth:           entry.Auth,
+			content:        entry.Content,
+			etag:           entry.Etag,
+			expiresAt:      entry.ExpiresAt,
+			fingerprint:    entry.Fingerprint,
+			freshUntil:     entry.FreshUntil,
+			header:         entry.Header,
+			host:           entry.Host,
+			lastModified:   entry.LastModified,
+			mustRevalidate: entry.MustRevalidate,
+			negative:       entry.Negative,
+			path:           entry.Path,
+			primaryKey:     entry.PrimaryKey,
+			status:         entry.Status,
+			url:            entry.Url,
+			validatedAt:    entry.ValidatedAt,
+			vary:           entry.Vary,
+		}
+	}
+
+	logger.Printf("[disk] Loaded %v of %v file(s)\n", len(loaded), len(paths))
+	return loaded, nil
+}
+
+// Writes queued writes as they come in. This never returns.
+func (d *DiskStore) run() {
+	for range d.wake {
+		d.flush()
+	}
+}
+
+// Queues an entry to be written. What's written is a copy of the entry as it
+// is now, so the caller must hold the cache's mutex.
+func (d *DiskStore) save(key string, cached *CachedResponse) {
+	d.queue(key, &diskEntry{
+		Auth:           cached.auth,
+		Content:        cached.content,
+		Etag:           cached.etag,
+		ExpiresAt:      cached.expiresAt,
+		Fingerprint:    cached.fingerprint,
+		FreshUntil:     cached.freshUntil,
+		Header:         cached.header,
+		Host:           cached.host,
+		Key:            key,
+		LastModified:   cached.lastModified,
+		MustRevalidate: cached.mustRevalidate,
+		Negative:       cached.negative,
+		Path:           cached.path,
+		PrimaryKey:     cached.primaryKey,
+		Status:         cached.status,
+		Url:            cached.url,
+		ValidatedAt:    cached.validatedAt,
+		Vary:           cached.vary,
+	})
+}
+
+// Reads usage data saved by the cache warmer. It's not an error for there to
+// be none.
+func (d *DiskStore) loadUsage(v interface{}) error {
+	err := d.read(filepath.Join(d.dir, UsageFileName), v)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DiskStore) saveUsage(v interface{}) error {
+	return d.write(filepath.Join(d.dir, UsageFileName), v)
+}
+
+func (d *DiskStore) notify() {
+	select {
+	case d.wake <- true:
+	default:
+	}
+}
+
+func (d *DiskStore) queue(key string, entry *diskEntry) {
+	d.mutex.Lock()
+	d.pendingMap[key] = entry
+	d.mutex.Unlock()
+	d.notify()
+}
+
+// Lists the files holding cache entries, which are named by the hex encoding
+// of a SHA-256 HMAC. This excludes the usage file as well as temporary files
+// that are still being written.
+func (d *DiskStore) entryPaths() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(d.dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	entryPaths := make([]string, 0, len(paths))
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if _, err := hex.DecodeString(name); err == nil && len(name) == 64 {
+			entryPaths = append(entryPaths, path)
+		}
+	}
+	return entryPaths, nil
+}
+
+// File names are a keyed hash of the cache key so that nothing about a
+// request can be learnt by listing the directory.
+func (d *DiskStore) path(key string) string {
+	mac := hmac.New(sha256.New, d.nameKey)
+	mac.Write([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Reads and decrypts a file, then decodes its JSON into v.
+func (d *DiskStore) read(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	nonceSize := d.aead.NonceSize()
+	if len(data) < nonceSize {
+		return fmt.Errorf("file too short")
+	}
+
+	decrypted, err := d.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decrypted, v)
+}
+
+// Encodes v as JSON, then encrypts it and writes it to a file.
+func (d *DiskStore) write(path string, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, d.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	data := d.aead.Seal(nonce, nonce, encoded, nil)
+
+	// TempFile creates files with 0600, and writing then renaming means that
+	// a concurrent load never sees a partially written file
+	file, err := ioutil.TempFile(d.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Produces a 32-byte key for the given purpose. Keys are derived from the
+// secret if there is one, and are random otherwise.
+func deriveKey(secret string, purpose string) ([]byte, error) {
+	if secret == "" {
+		key := make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, key)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil), nil
+}
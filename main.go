@@ -29,6 +29,9 @@ func initLogger(verbose bool) *log.Logger {
 
 func main() {
 	verbose := flag.BoolP("verbose", "v", false, "Verbose mode")
+
+	// stop at the command so that it can have flags of its own
+	flag.SetInterspersed(false)
 	flag.Parse()
 
 	logger = initLogger(*verbose)
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The effective caching behavior for a request, as determined by the first
+// matching rule with anything that it doesn't specify taken from the
+// daemon's configuration.
+type CachePolicy struct {
+	cache        bool
+	freshWindow  time.Duration
+	persist      bool
+	staleOnError staleOnErrorPolicy
+
+	// The number of the rule that matched, counting from one, or zero if
+	// none did.
+	rule int
+}
+
+// Overrides caching behavior for requests to a host (or any host if "*") with
+// a path matching a pattern like `/apps/*/config-vars`. Fields that are nil or
+// zero leave the default in place.
+type PolicyRule struct {
+	host    string
+	pattern string
+
+	cache        *bool
+	freshWindow  time.Duration
+	persist      *bool
+	staleOnError *staleOnErrorPolicy
+}
+
+// The format of the policy file. For example:
+//
+//	{
+//	  "rules": [
+//	    {"path": "/apps/*/config-vars", "cache": false},
+//	    {"host": "api.heroku.com", "path": "/account", "ttl": "1m",
+//	     "stale_on_error": "always", "persist": false}
+//	  ]
+//	}
+type policyFile struct {
+	Rules []struct {
+		Cache        *bool  `json:"cache"`
+		Host         string `json:"host"`
+		Path         string `json:"path"`
+		Persist      *bool  `json:"persist"`
+		StaleOnError string `json:"stale_on_error"`
+		Ttl          string `json:"ttl"`
+	} `json:"rules"`
+}
+
+func (p *CachePolicy) String() string {
+	staleOnError := "off"
+	if p.staleOnError.enabled && p.staleOnError.maxStale > 0 {
+		staleOnError = p.staleOnError.maxStale.String()
+	} else if p.staleOnError.enabled {
+		staleOnError = "always"
+	}
+
+	rule := "default"
+	if p.rule > 0 {
+		rule = fmt.Sprintf("%v", p.rule)
+	}
+
+	return fmt.Sprintf("[cache=%v] [ttl=%v] [stale_on_error=%s] [persist=%v] [rule=%s]",
+		p.cache, p.freshWindow, staleOnError, p.persist, rule)
+}
+
+// Whether a rule applies to a canonical host and a cleaned path.
+func (r *PolicyRule) matches(host string, p string) bool {
+	if r.host != "*" && r.host != host {
+		return false
+	}
+	ok, _ := path.Match(r.pattern, p)
+	return ok
+}
+
+// Resolves the effective policy for a request.
+func (c *RequestCache) policyFor(request *http.Request) *CachePolicy {
+	return c.policyForPath(canonicalHost(request.Host), cleanPath(request.URL.Path))
+}
+
+// Resolves the effective policy for a canonical host and a cleaned path, like
+// those of a cached entry.
+func (c *RequestCache) policyForPath(host string, p string) *CachePolicy {
+	policy := &CachePolicy{
+		cache:        true,
+		persist:      true,
+		staleOnError: c.staleOnError,
+	}
+
+	for i, r := range c.policyRules {
+		if !r.matches(host, p) {
+			continue
+		}
+
+		policy.rule = i + 1
+		policy.freshWindow = r.freshWindow
+		if r.cache != nil {
+			policy.cache = *r.cache
+		}
+		if r.persist != nil {
+			policy.persist = *r.persist
+		}
+		if r.staleOnError != nil {
+			policy.staleOnError = *r.staleOnError
+		}
+		break
+	}
+
+	return policy
+}
+
+// Reads rules from a policy file. It's fine for the file not to exist, in
+// which case there are no rules.
+func loadPolicyFile(filename string) ([]PolicyRule, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := &policyFile{}
+	err = json.Unmarshal(data, file)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]PolicyRule, 0, len(file.Rules))
+	for i, r := range file.Rules {
+		rule := PolicyRule{
+			cache:   r.Cache,
+			host:    canonicalHost(r.Host),
+			pattern: cleanPath(r.Path),
+			persist: r.Persist,
+		}
+
+		if rule.host == "" {
+			rule.host = "*"
+		}
+
+		if _, err := path.Match(rule.pattern, "/"); err != nil {
+			return nil, fmt.Errorf("rule %v: bad path %s: %s", i+1, r.Path, err.Error())
+		}
+
+		if r.Ttl != "" {
+			rule.freshWindow, err = time.ParseDuration(r.Ttl)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v: bad ttl: %s", i+1, err.Error())
+			}
+		}
+
+		if r.StaleOnError != "" {
+			staleOnError, err := parseStaleOnError(r.StaleOnError)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v: bad stale_on_error: %s", i+1, err.Error())
+			}
+			rule.staleOnError = &staleOnError
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Parses fresh windows, which are comma-separated and look like
+// `api.heroku.com/account=30s`, into rules. A host of "*" matches any host,
+// and `*` in a path matches a single segment.
+func parseFreshWindows(s string) ([]PolicyRule, error) {
+	rules := make([]PolicyRule, 0)
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.LastIndex(spec, "=")
+		j := strings.Index(spec, "/")
+		if i == -1 || j == -1 || j > i {
+			return nil, fmt.Errorf("expected host/path=duration: %s", spec)
+		}
+
+		window, err := time.ParseDuration(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		pattern := spec[j:i]
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %s", pattern, err.Error())
+		}
+
+		rules = append(rules, PolicyRule{
+			freshWindow: window,
+			host:        canonicalHost(spec[0:j]),
+			pattern:     cleanPath(pattern),
+		})
+	}
+	return rules, nil
+}
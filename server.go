@@ -15,7 +15,12 @@ var (
 )
 
 type State struct {
+	CacheBodies    int
+	CacheBytes     int
 	CacheCount     int
+	CacheMaxBytes  int
+	CacheMaxCount  int
+	CacheStats     map[string]CacheStats
 	TwoFactorCount int
 	StopChan       chan int
 	UpAt           time.Time
@@ -30,6 +35,28 @@ func Serve() {
 	proxyListener := initListener(getProxySocketPath())
 	controlListener := initListener(getControlSocketPath())
 
+	// apply cache limits and pick up anything that a previous daemon
+	// persisted; this happens only after we've claimed our sockets so that a
+	// second daemon that's about to exit doesn't touch the files of the one
+	// that's already running
+	InitFingerprintKey()
+	InitCache()
+	InitTwoFactorStore()
+	InitTwoFactorPrompter()
+
+	// warming requests skip the WarmHandler so that they don't count as
+	// usage, and the TwoFactorPromptHandler because there's nobody to enter a
+	// code for them, but otherwise go through the same chain as a client's
+	// would
+	InitCacheWarmer(buildChain([]HandlerFunc{
+		LogHandler,
+		ErrorHandler,
+		TwoFactorHandler,
+		CacheHandler,
+		CoalesceHandler,
+		ProxyHandler,
+	}))
+
 	// register and start serving on the control socket so that a heroku-agent
 	// running in "command mode" can connect and make a call
 	rpc.Register(&RpcReceiver{
@@ -49,12 +76,20 @@ func Serve() {
 	// bloat out of control
 	go ReapCache()
 	go ReapTwoFactorStore()
+	go RenewTwoFactorStore()
+
+	go RunCacheWriter()
+
+	go RunCacheWarmer()
 
 	http.HandleFunc("/", BuildHandlerChain([]HandlerFunc{
 		LogHandler,
 		ErrorHandler,
+		WarmHandler,
+		TwoFactorPromptHandler,
 		TwoFactorHandler,
 		CacheHandler,
+		CoalesceHandler,
 		ProxyHandler,
 	}))
 
@@ -89,6 +124,12 @@ func handleSignals(stopChan chan int) {
 func handleStop(StopChan chan int, listeners ...net.Listener) {
 	status := <-StopChan
 
+	SaveCacheWarmer()
+	FlushCache()
+
+	// revoke held tokens so that they don't outlive the daemon
+	ClearTwoFactorStore()
+
 	// stop listening (and unlink the socket if unix type)
 	for _, listener := range listeners {
 		listener.Close()
@@ -123,12 +164,45 @@ type RpcReceiver struct {
 	State *State
 }
 
+func (r *RpcReceiver) CacheList(_ []string, entries *[]CacheEntry) error {
+	start := time.Now()
+	r.logStart("CacheList")
+	defer r.logFinish("CacheList", start)
+
+	*entries = ListCache()
+	return nil
+}
+
+func (r *RpcReceiver) CachePurge(args CachePurgeArgs, count *int) error {
+	start := time.Now()
+	r.logStart("CachePurge")
+	defer r.logFinish("CachePurge", start)
+
+	*count = PurgeCache(args)
+	return nil
+}
+
+func (r *RpcReceiver) CacheShow(id string, entry *CacheEntryDetail) error {
+	start := time.Now()
+	r.logStart("CacheShow")
+	defer r.logFinish("CacheShow", start)
+
+	detail, err := ShowCache(id)
+	if err != nil {
+		return err
+	}
+
+	*entry = *detail
+	return nil
+}
+
 func (r *RpcReceiver) Clear(_ []string, _ *[]string) error {
 	start := time.Now()
 	r.logStart("Clear")
 	defer r.logFinish("Clear", start)
 
 	ClearCache()
+	ClearCacheWarmer()
 	ClearTwoFactorStore()
 	return nil
 }
@@ -138,7 +212,11 @@ func (r *RpcReceiver) GetState(_ []string, s *State) error {
 	r.logStart("State")
 	defer r.logFinish("State", start)
 
+	s.CacheBodies = CacheBodyCount()
+	s.CacheBytes = CacheSize()
 	s.CacheCount = CacheCount()
+	s.CacheMaxBytes, s.CacheMaxCount = CacheLimits()
+	s.CacheStats = CacheStatsByHost()
 	s.TwoFactorCount = TwoFactorStoreCount()
 	s.UpAt = state.UpAt
 
@@ -155,6 +233,29 @@ func (r *RpcReceiver) Stop(_ []string, _ *[]string) error {
 	return nil
 }
 
+func (r *RpcReceiver) TwoFactorCode(args TwoFactorCodeArgs, count *int) error {
+	start := time.Now()
+	r.logStart("TwoFactorCode")
+	defer r.logFinish("TwoFactorCode", start)
+
+	numResumed, err := SupplyTwoFactorCode(args)
+	if err != nil {
+		return err
+	}
+
+	*count = numResumed
+	return nil
+}
+
+func (r *RpcReceiver) TwoFactorPending(_ []string, pending *[]PendingRequest) error {
+	start := time.Now()
+	r.logStart("TwoFactorPending")
+	defer r.logFinish("TwoFactorPending", start)
+
+	*pending = ListPendingRequests()
+	return nil
+}
+
 func (r *RpcReceiver) UpgradeToken(token string, resp *string) error {
 	start := time.Now()
 	r.logStart("UpgradeToken")
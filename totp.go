@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Codes are generated as described by RFC 6238 with the parameters that
+	// every authenticator app uses by default.
+	TotpDigits = 6
+	TotpPeriod = 30 * time.Second
+)
+
+// Reads a base32-encoded TOTP secret, as shown by an authenticator app's
+// setup screen, from a file. The file must be readable only by its owner.
+func loadTotpSecret(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s must not be accessible by other users (chmod 600)", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// secrets are often shown in groups separated by spaces and without
+	// padding
+	encoded := strings.ToUpper(strings.Join(strings.Fields(string(data)), ""))
+	encoded = strings.TrimRight(encoded, "=")
+	if encoded == "" {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base32: %s", path, err.Error())
+	}
+	return secret, nil
+}
+
+// Generates the code for the time step containing t.
+func totpCode(secret []byte, t time.Time) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/int64(TotpPeriod/time.Second)))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation picks four bytes at an offset given by the last
+	// nibble of the HMAC
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < TotpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TotpDigits, value%modulus)
+}
+
+// How long the code for the time step containing t remains valid.
+func totpRemaining(t time.Time) time.Duration {
+	period := int64(TotpPeriod / time.Second)
+	return time.Duration(period-t.Unix()%period) * time.Second
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238, truncated to six digits.
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range vectors {
+		code := totpCode(secret, time.Unix(v.unix, 0))
+		if code != v.code {
+			t.Errorf("code at %v: expected %s, got %s", v.unix, v.code, code)
+		}
+	}
+}
@@ -1,10 +1,7 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -12,37 +9,86 @@ import (
 	"time"
 )
 
+const (
+	// How long a privileged token is requested for unless configured
+	// otherwise.
+	DefaultTwoFactorTokenLifetime = 30 * time.Minute
+
+	// The shortest lifetime that can be configured. Renewal is checked for
+	// once a minute, so a shorter-lived token could expire before it's
+	// renewed.
+	MinTwoFactorTokenLifetime = 2 * time.Minute
+
+	// How long before a privileged token expires that it's renewed, if
+	// renewal is enabled. Tokens with short lifetimes are renewed halfway
+	// through them instead.
+	TwoFactorRenewalLead = 5 * time.Minute
+
+	// How long clearing the store waits for held tokens to be revoked. Any
+	// that aren't by then are collected by the next daemon instead.
+	TwoFactorRevocationTimeout = 5 * time.Second
+)
+
 type SecondFactor struct {
 	expiresAt time.Time
 	token     string
+
+	// The API host that the token was issued by, which is where it's renewed
+	// and revoked.
+	host string
+
+	// The ID of the token's authorization, which is deleted when the token is
+	// no longer needed so that it doesn't linger on the account.
+	id string
+
+	// The authorization that the code was sent with, which can still delete
+	// the token's authorization once the token itself has expired.
+	ownerAuth string
+
+	// When the code that this token descends from was entered. Renewals carry
+	// it forward so that a session can't be extended indefinitely.
+	sessionStartedAt time.Time
 }
 
 var (
 	store *TwoFactorStore
 )
 
-type CreateAuthorizationRequest struct {
-	Description   string `json:"description"`
-	ExpiresIn     int    `json:"expires_in"`
-	SkipTwoFactor bool   `json:"skip_two_factor"`
-}
-
-type CreateAuthorizationResponse struct {
-	AccessToken struct {
-		ExpiresIn int    `json:"expires_in"`
-		Token     string `json:"token"`
-	} `json:"access_token"`
-}
-
 type TwoFactorStore struct {
 	secondFactorMap map[string]*SecondFactor
 	mutex           *sync.Mutex
+
+	// Identities (by host) for which we've already looked for authorizations
+	// left behind by a previous daemon.
+	collectedMap map[string]bool
+
+	// How long after a code was entered that its privileged token may keep
+	// being renewed. Zero disables renewal, so that tokens simply expire.
+	maxSession time.Duration
+
+	// Only authorizations created before this daemon started can have been
+	// left behind by a previous one.
+	startedAt time.Time
+
+	// How long a privileged token is requested for.
+	tokenLifetime time.Duration
+
+	// A secret from which codes are generated whenever the API asks for a
+	// second factor, or nil if codes have to come from the user.
+	totpSecret []byte
+
+	// Serializes exchanging generated codes. A code can only be exchanged
+	// once, so concurrent requests refused in the same period have to share
+	// the token that the first of them gets.
+	totpMutex *sync.Mutex
 }
 
 func init() {
 	store = &TwoFactorStore{
+		collectedMap:    make(map[string]bool),
 		secondFactorMap: make(map[string]*SecondFactor),
 		mutex:           &sync.Mutex{},
+		totpMutex:       &sync.Mutex{},
 	}
 }
 
@@ -50,6 +96,35 @@ func ClearTwoFactorStore() {
 	store.clear()
 }
 
+func InitTwoFactorStore() {
+	store.maxSession = getEnvDuration("HEROKU_AGENT_TWO_FACTOR_MAX_SESSION", 0)
+	store.tokenLifetime = getEnvDuration("HEROKU_AGENT_TWO_FACTOR_TOKEN_LIFETIME",
+		DefaultTwoFactorTokenLifetime)
+	if store.tokenLifetime < MinTwoFactorTokenLifetime {
+		fail(1, fmt.Errorf("invalid HEROKU_AGENT_TWO_FACTOR_TOKEN_LIFETIME: must be at least %v",
+			MinTwoFactorTokenLifetime))
+	}
+
+	id, err := loadRandomHex(getInstallIdPath(), 8)
+	if err != nil {
+		fail(1, fmt.Errorf("invalid install ID: %s", err.Error()))
+	}
+	installId = id
+
+	if path := getTotpSecretPath(); path != "" {
+		secret, err := loadTotpSecret(path)
+		if err != nil {
+			fail(1, fmt.Errorf("invalid TOTP secret: %s", err.Error()))
+		}
+		store.totpSecret = secret
+		logger.Printf("[2fa] Loaded TOTP secret; codes will be generated as needed\n")
+	}
+
+	// the API reports creation times to the second, so an authorization
+	// created in the second that we started counts as one of ours
+	store.startedAt = time.Now().Truncate(time.Second)
+}
+
 func ReapTwoFactorStore() {
 	for {
 		select {
@@ -59,11 +134,47 @@ func ReapTwoFactorStore() {
 	}
 }
 
+// Periodically renews privileged tokens that are about to expire, as long as
+// their sessions haven't run out.
+func RenewTwoFactorStore() {
+	if store.maxSession <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(1 * time.Minute):
+			store.renew()
+		}
+	}
+}
+
 func TwoFactorStoreCount() int {
 	return store.count()
 }
 
 func TwoFactorHandler(r *http.Request, next NextHandlerFunc) (*httptest.ResponseRecorder, error) {
+	// the first time that we see an identity at the API, look for any
+	// privileged tokens that a previous daemon created for it but never got to
+	// revoke
+	if auth := r.Header.Get("Authorization"); hasAuth(auth) && isApiHost(r.Host) &&
+		store.startCollection(r.Host, auth) {
+		go store.collectOrphans(r.Host, auth)
+	}
+
+	// With a TOTP secret, we can answer the API asking for a second factor by
+	// generating a code ourselves, but then the request needs to be made
+	// again exactly as it was sent.
+	var restore func()
+	if store.totpSecret != nil && hasAuth(r.Header.Get("Authorization")) &&
+		r.Header.Get("Heroku-Two-Factor-Code") == "" {
+		var err error
+		restore, err = captureRequest(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// replace our sent authorization if we're holding a more privileged token
 	// already
 	if !store.tryStoredSecondFactor(r) {
@@ -85,11 +196,23 @@ func TwoFactorHandler(r *http.Request, next NextHandlerFunc) (*httptest.Response
 		}
 	}
 
+	sentAuth := r.Header.Get("Authorization")
+	w, err := next(r)
+	if restore == nil || err != nil || !isTwoFactorRequired(w) {
+		return w, err
+	}
+
+	if !store.upgradeWithTotp(r, restore, sentAuth) {
+		return w, err
+	}
 	return next(r)
 }
 
 func UpgradeToken(token string) (string, bool) {
-	secondFactor, ok := store.secondFactorMap[token]
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	secondFactor, ok := store.secondFactorMap[authKey(token)]
 	if ok {
 		return secondFactor.token, true
 	} else {
@@ -97,107 +220,266 @@ func UpgradeToken(token string) (string, bool) {
 	}
 }
 
+// Identifies whose cache entries a request made with the given authorization
+// should use. A held privileged token stands in for the client's own
+// authorization, but changes with every renewal, so its entries are keyed on
+// that authorization and the session that the token belongs to instead.
+// They're then kept across renewals, but not once the session is over.
+func cacheIdentity(auth string) string {
+	if key, ok := store.sessionKey(auth); ok {
+		return key
+	}
+	return authKey(auth)
+}
+
 func hasAuth(auth string) bool {
 	// "Og==" is just a colon ":" encoded in base64 (no user/pass)
 	return auth != "" && !strings.HasSuffix(auth, "Og==")
 }
 
-func (s *TwoFactorStore) getSkipTwoFactorToken(r *http.Request) (*SecondFactor, error) {
-	authUrl := "https://" + r.Host + "/oauth/authorizations"
-	auth := r.Header.Get("Authorization")
-	sentToken := r.Header.Get("Heroku-Two-Factor-Code")
+// Deletes a token's authorization, using the token itself if it's still valid
+// and the authorization that it was created with otherwise.
+func revokeSecondFactor(secondFactor *SecondFactor) {
+	if secondFactor.id == "" {
+		return
+	}
 
-	requestData := &CreateAuthorizationRequest{
-		Description:   "heroku-agent",
-		ExpiresIn:     60 * 30,
-		SkipTwoFactor: true,
+	auth := "Bearer " + secondFactor.token
+	if !secondFactor.expiresAt.After(time.Now()) {
+		auth = secondFactor.ownerAuth
 	}
-	encoded, err := json.Marshal(requestData)
+
+	err := deleteAuthorization(secondFactor.host, auth, secondFactor.id)
 	if err != nil {
-		return nil, err
+		logger.Printf("[2fa] Error revoking authorization %s: %s\n",
+			secondFactor.id, err.Error())
+		return
 	}
+	logger.Printf("[2fa] Revoked authorization %s\n", secondFactor.id)
+}
 
-	req, err := http.NewRequest("POST", authUrl, bytes.NewBuffer(encoded))
+// Revokes authorizations that were created by a previous daemon of this
+// installation, along with expired ones created by older versions of heroku-agent.
+func (s *TwoFactorStore) collectOrphans(host string, auth string) {
+	authorizations, err := listAuthorizations(host, auth)
 	if err != nil {
-		return nil, err
+		logger.Printf("[2fa] Error listing authorizations: %s\n", err.Error())
+		return
 	}
 
-	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
-	req.Header.Set("Authorization", auth)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Heroku-Two-Factor-Code", sentToken)
-
-	resp, err := DoRequest(req)
-	if err != nil {
-		return nil, err
+	s.mutex.Lock()
+	heldIds := make(map[string]bool)
+	for _, v := range s.secondFactorMap {
+		heldIds[v.id] = true
 	}
-	defer resp.Body.Close()
+	s.mutex.Unlock()
 
-	if resp.StatusCode != 201 {
-		return nil, fmt.Errorf("Unexpected response code: %v", resp.StatusCode)
+	numRevoked := 0
+	for _, a := range authorizations {
+		if !isOrphanedAuthorization(&a, heldIds, s.startedAt) {
+			continue
+		}
+
+		err := deleteAuthorization(host, auth, a.Id)
+		if err != nil {
+			logger.Printf("[2fa] Error revoking orphaned authorization %s: %s\n",
+				a.Id, err.Error())
+			continue
+		}
+		numRevoked++
 	}
 
-	encoded, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	logger.Printf("[2fa] Revoked %v orphaned authorization(s)\n", numRevoked)
+}
+
+// Exchanges the code sent with a request for a privileged token. If no code
+// was sent, one is generated if we're holding a TOTP secret.
+func (s *TwoFactorStore) getSkipTwoFactorToken(r *http.Request) (*SecondFactor, error) {
+	auth := r.Header.Get("Authorization")
+	code := r.Header.Get("Heroku-Two-Factor-Code")
+	if code == "" && s.totpSecret != nil {
+		code = totpCode(s.totpSecret, time.Now())
 	}
 
-	responseData := &CreateAuthorizationResponse{}
-	err = json.Unmarshal(encoded, responseData)
+	secondFactor, err := createSkipTwoFactorToken(r.Host, auth, code, s.tokenLifetime)
 	if err != nil {
 		return nil, err
 	}
 
-	secondFactor := &SecondFactor{
-		expiresAt: time.Now().Add(time.Duration(responseData.AccessToken.ExpiresIn) * time.Second),
-		token:     responseData.AccessToken.Token,
-	}
+	secondFactor.ownerAuth = auth
+	secondFactor.sessionStartedAt = time.Now()
 	return secondFactor, nil
 }
 
+// Forgets every held token and revokes it. Revocation happens outside the
+// lock, but before returning so that a stopping daemon can wait on it. Tokens
+// are revoked all at once and for no longer than TwoFactorRevocationTimeout so
+// that a slow API can't hold up stopping.
 func (s *TwoFactorStore) clear() {
-	numKeys := len(s.secondFactorMap)
-	for k := range s.secondFactorMap {
+	s.mutex.Lock()
+	cleared := make([]*SecondFactor, 0, len(s.secondFactorMap))
+	for k, v := range s.secondFactorMap {
+		cleared = append(cleared, v)
 		delete(s.secondFactorMap, k)
 	}
-	logger.Printf("[2fa] Cleared %v second factor(s)\n", numKeys)
+	s.mutex.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, secondFactor := range cleared {
+		wg.Add(1)
+		go func(secondFactor *SecondFactor) {
+			defer wg.Done()
+			revokeSecondFactor(secondFactor)
+		}(secondFactor)
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(TwoFactorRevocationTimeout):
+		logger.Printf("[2fa] Gave up waiting for revocations after %v\n",
+			TwoFactorRevocationTimeout)
+	}
+	logger.Printf("[2fa] Cleared %v second factor(s)\n", len(cleared))
 }
 
 func (s *TwoFactorStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return len(s.secondFactorMap)
 }
 
 func (s *TwoFactorStore) reap() {
+	s.mutex.Lock()
 	numKeys := len(s.secondFactorMap)
 	now := time.Now()
-	expiredKeys := make([]string, 0)
+	expired := make([]*SecondFactor, 0)
 
 	for k, v := range s.secondFactorMap {
 		if now.After(v.expiresAt) {
-			expiredKeys = append(expiredKeys, k)
+			expired = append(expired, v)
+			delete(s.secondFactorMap, k)
 		}
 	}
+	s.mutex.Unlock()
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	for _, k := range expiredKeys {
-		delete(s.secondFactorMap, k)
+	for _, secondFactor := range expired {
+		revokeSecondFactor(secondFactor)
 	}
 
 	logger.Printf("[2fa] Reaped %v of %v second factor(s)\n",
-		len(expiredKeys), numKeys)
+		len(expired), numKeys)
 }
 
-func (s *TwoFactorStore) setSecondFactor(r *http.Request, secondFactor *SecondFactor) {
-	auth := normalizeAuth(r.Header.Get("Authorization"))
+// Replaces tokens that are about to expire with new ones requested using the
+// tokens themselves, so that no code needs to be entered. A replacement never
+// outlives the session that its token belongs to.
+func (s *TwoFactorStore) renew() {
+	now := time.Now()
+	dueMap := make(map[string]*SecondFactor)
+
+	lead := TwoFactorRenewalLead
+	if s.tokenLifetime/2 < lead {
+		lead = s.tokenLifetime / 2
+	}
+
+	s.mutex.Lock()
+	for k, v := range s.secondFactorMap {
+		sessionEndsAt := v.sessionStartedAt.Add(s.maxSession)
+		if v.expiresAt.After(now) && v.expiresAt.Sub(now) <= lead &&
+			sessionEndsAt.After(v.expiresAt) {
+			dueMap[k] = v
+		}
+	}
+	s.mutex.Unlock()
+
+	for k, v := range dueMap {
+		sessionEndsAt := v.sessionStartedAt.Add(s.maxSession)
+		lifetime := s.tokenLifetime
+		if remaining := sessionEndsAt.Sub(now); remaining < lifetime {
+			lifetime = remaining
+		}
+
+		renewed, err := createSkipTwoFactorToken(v.host, "Bearer "+v.token, "", lifetime)
+		if err != nil {
+			logger.Printf("[2fa] Error renewing 2FA token: %s\n", err.Error())
+			continue
+		}
+		renewed.ownerAuth = v.ownerAuth
+		renewed.sessionStartedAt = v.sessionStartedAt
+
+		s.mutex.Lock()
+		// the token may have been cleared or replaced while we were renewing
+		// it, in which case the renewal is no longer wanted
+		current := s.secondFactorMap[k] == v
+		if current {
+			s.secondFactorMap[k] = renewed
+		}
+		s.mutex.Unlock()
+
+		if !current {
+			revokeSecondFactor(renewed)
+			continue
+		}
+
+		logger.Printf("[2fa] 2FA token renewed (valid for %v, session ends in %v)\n",
+			renewed.expiresAt.Sub(now), sessionEndsAt.Sub(now))
+		revokeSecondFactor(v)
+	}
+}
+
+// Returns a key for the session of the held token that an authorization
+// carries, or false if it doesn't carry one.
+func (s *TwoFactorStore) sessionKey(auth string) (string, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+
+	for _, secondFactor := range s.secondFactorMap {
+		if "Bearer "+secondFactor.token == auth {
+			return authKey(secondFactor.ownerAuth + "|session " +
+				secondFactor.sessionStartedAt.Format(time.RFC3339Nano)), true
+		}
+	}
+	return "", false
+}
+
+func (s *TwoFactorStore) setSecondFactor(r *http.Request, secondFactor *SecondFactor) {
+	auth := authKey(r.Header.Get("Authorization"))
+	s.mutex.Lock()
+	replaced, ok := s.secondFactorMap[auth]
 	s.secondFactorMap[auth] = secondFactor
+	s.mutex.Unlock()
+
 	logger.Printf("[2fa] 2FA token acquired; set in cache\n")
+	if ok {
+		go revokeSecondFactor(replaced)
+	}
+}
+
+// Returns true if orphaned authorizations haven't yet been looked for on
+// behalf of an identity, and marks them as having been.
+func (s *TwoFactorStore) startCollection(host string, auth string) bool {
+	key := canonicalHost(host) + "|" + authKey(auth)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.collectedMap[key] {
+		return false
+	}
+	s.collectedMap[key] = true
+	return true
 }
 
 func (s *TwoFactorStore) tryStoredSecondFactor(r *http.Request) bool {
-	auth := normalizeAuth(r.Header.Get("Authorization"))
+	auth := authKey(r.Header.Get("Authorization"))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	secondFactor, ok := s.secondFactorMap[auth]
 
 	if ok {
@@ -208,6 +490,7 @@ func (s *TwoFactorStore) tryStoredSecondFactor(r *http.Request) bool {
 			return true
 		} else {
 			delete(s.secondFactorMap, auth)
+			go revokeSecondFactor(secondFactor)
 			logger.Printf("[2fa] 2FA token expired; removed from cache\n")
 		}
 	} else {
@@ -216,3 +499,30 @@ func (s *TwoFactorStore) tryStoredSecondFactor(r *http.Request) bool {
 
 	return false
 }
+
+// Prepares a request that was refused for want of a second factor to be made
+// again with a privileged token, generating a code and exchanging it for one
+// unless another request already has since sentAuth was tried. Returns false
+// if no token could be had, in which case the refusal stands.
+func (s *TwoFactorStore) upgradeWithTotp(r *http.Request, restore func(), sentAuth string) bool {
+	s.totpMutex.Lock()
+	defer s.totpMutex.Unlock()
+
+	restore()
+	if s.tryStoredSecondFactor(r) && r.Header.Get("Authorization") != sentAuth {
+		return true
+	}
+
+	restore()
+	logger.Printf("[2fa] 2FA required; generating a code\n")
+	secondFactor, err := s.getSkipTwoFactorToken(r)
+	if err != nil {
+		logger.Printf("[2fa] Error upgrading with a generated code: %s\n",
+			err.Error())
+
+		// a code may have been supplied some other way in the meantime
+		return s.tryStoredSecondFactor(r) && r.Header.Get("Authorization") != sentAuth
+	}
+	s.setSecondFactor(r, secondFactor)
+	return s.tryStoredSecondFactor(r)
+}
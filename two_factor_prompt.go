@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	prompter *TwoFactorPrompter
+)
+
+// A request that's waiting for a second factor code, as shown by
+// `heroku-agent 2fa`.
+type PendingRequest struct {
+	Auth     string
+	Host     string
+	Id       string
+	Method   string
+	ParkedAt time.Time
+	Url      string
+}
+
+// Identifies which pending requests a code is for. Without an ID, the code is
+// for whichever authorization is waiting, as long as there's only one.
+type TwoFactorCodeArgs struct {
+	Code string
+	Id   string
+}
+
+// Holds requests that the API refused for want of a second factor until a
+// code is supplied through the control socket, then completes them with a
+// privileged token so that clients never see the refusal.
+type TwoFactorPrompter struct {
+	mutex     *sync.Mutex
+	parkedMap map[string]*parkedRequest
+
+	// How long a request is held before giving up and passing the API's
+	// refusal on to the client. Zero disables holding requests entirely.
+	hold time.Duration
+}
+
+type parkedRequest struct {
+	auth    string
+	authKey string
+	pending PendingRequest
+	resume  chan bool
+}
+
+func init() {
+	prompter = &TwoFactorPrompter{
+		mutex:     &sync.Mutex{},
+		parkedMap: make(map[string]*parkedRequest),
+	}
+}
+
+func InitTwoFactorPrompter() {
+	prompter.hold = getEnvDuration("HEROKU_AGENT_TWO_FACTOR_HOLD", 0)
+}
+
+func ListPendingRequests() []PendingRequest {
+	return prompter.list()
+}
+
+// Exchanges a code for a privileged token, then resumes every request that
+// was waiting on behalf of the same authorization. Returns the number of
+// requests resumed.
+func SupplyTwoFactorCode(args TwoFactorCodeArgs) (int, error) {
+	return prompter.supply(args)
+}
+
+// Holds requests that fail with `two_factor` until a code is supplied. This
+// comes before the TwoFactorHandler so that once a privileged token is held,
+// the request can be made again with it.
+func TwoFactorPromptHandler(r *http.Request, next NextHandlerFunc) (*httptest.ResponseRecorder, error) {
+	auth := r.Header.Get("Authorization")
+	if prompter.hold <= 0 || !hasAuth(auth) || r.Header.Get("Heroku-Two-Factor-Code") != "" {
+		return next(r)
+	}
+
+	// handlers further down modify the request, so it's captured as it is
+	// now for it to be made again
+	restore, err := captureRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := next(r)
+	if err != nil || !isTwoFactorRequired(w) {
+		return w, err
+	}
+
+	if !prompter.park(r, auth) {
+		return w, err
+	}
+
+	restore()
+	return next(r)
+}
+
+// Whether the API refused a request because it needs a second factor.
+func isTwoFactorRequired(w *httptest.ResponseRecorder) bool {
+	if w.Code != 403 {
+		return false
+	}
+
+	apiError := &HerokuApiError{}
+	err := json.Unmarshal(w.Body.Bytes(), apiError)
+	return err == nil && apiError.Id == "two_factor"
+}
+
+func newPendingRequestId() (string, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (p *TwoFactorPrompter) list() []PendingRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	requests := make([]PendingRequest, 0, len(p.parkedMap))
+	for _, parked := range p.parkedMap {
+		requests = append(requests, parked.pending)
+	}
+	return requests
+}
+
+// Waits for a code to be supplied for a request. Returns true if one was and
+// a privileged token is now held, or false if we gave up waiting.
+func (p *TwoFactorPrompter) park(r *http.Request, auth string) bool {
+	id, err := newPendingRequestId()
+	if err != nil {
+		logger.Printf("[2fa] Error parking request: %s\n", err.Error())
+		return false
+	}
+
+	parked := &parkedRequest{
+		auth:    auth,
+		authKey: authKey(auth),
+		pending: PendingRequest{
+			Auth:     fingerprintAuth(auth),
+			Host:     r.Host,
+			Id:       id,
+			Method:   r.Method,
+			ParkedAt: time.Now(),
+			Url:      safeUrl(r.URL),
+		},
+		resume: make(chan bool, 1),
+	}
+
+	p.mutex.Lock()
+	p.parkedMap[id] = parked
+	p.mutex.Unlock()
+
+	logger.Printf("[2fa] 2FA required; holding %s %s%s for a code [id=%s]\n",
+		r.Method, r.Host, safeUrl(r.URL), id)
+
+	select {
+	case <-parked.resume:
+		return true
+	case <-time.After(p.hold):
+	}
+
+	// a code may have been supplied just as we gave up, in which case the
+	// request was already taken off the map and should go ahead
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.parkedMap[id]; !ok {
+		return true
+	}
+	delete(p.parkedMap, id)
+
+	logger.Printf("[2fa] No code supplied; passing on 2FA requirement [id=%s]\n", id)
+	return false
+}
+
+func (p *TwoFactorPrompter) supply(args TwoFactorCodeArgs) (int, error) {
+	target, err := p.target(args.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	upgrade := &http.Request{
+		Header: make(http.Header),
+		Host:   target.pending.Host,
+	}
+	upgrade.Header.Set("Authorization", target.auth)
+	upgrade.Header.Set("Heroku-Two-Factor-Code", args.Code)
+
+	secondFactor, err := store.getSkipTwoFactorToken(upgrade)
+	if err != nil {
+		return 0, err
+	}
+	store.setSecondFactor(upgrade, secondFactor)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	numResumed := 0
+	for id, parked := range p.parkedMap {
+		if parked.authKey != target.authKey {
+			continue
+		}
+		delete(p.parkedMap, id)
+		parked.resume <- true
+		numResumed++
+	}
+
+	logger.Printf("[2fa] Code supplied; resuming %v request(s)\n", numResumed)
+	return numResumed, nil
+}
+
+// Finds the request that a code is for, either by a prefix of its ID or as
+// the only authorization with requests waiting.
+func (p *TwoFactorPrompter) target(id string) (*parkedRequest, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var target *parkedRequest
+	for k, parked := range p.parkedMap {
+		if !strings.HasPrefix(k, id) {
+			continue
+		}
+		if target != nil && target.authKey != parked.authKey {
+			return nil, fmt.Errorf("requests for more than one authorization are waiting; choose one with --id")
+		}
+		target = parked
+	}
+
+	if target == nil && id != "" {
+		return nil, fmt.Errorf("no waiting request matches %s", id)
+	}
+	if target == nil {
+		return nil, fmt.Errorf("no requests are waiting for a code")
+	}
+	return target, nil
+}
@@ -1,25 +1,100 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	homedir "github.com/mitchellh/go-homedir"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	DefaultControlSocketPath = "~/.heroku-agent-control.sock"
+	DefaultPolicyFilePath    = "~/.heroku-agent-policy.json"
 	DefaultProxySocketPath   = "~/.heroku-agent.sock"
+
+	// The key for the HMAC that derives map keys from authorizations. It's
+	// random unless the cache is being persisted with a secret, in which case
+	// it must be the same across daemons so that persisted keys still match.
+	authKeySecret []byte
+
+	// The key for the HMAC that fingerprints authorizations for display. It's
+	// kept on disk so that fingerprints are the same across daemons, and it's
+	// secret so that a fingerprint can't be used to check guesses at a
+	// password.
+	fingerprintKey []byte
 )
 
+func init() {
+	authKeySecret = make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, authKeySecret)
+	if err != nil {
+		panic(err)
+	}
+
+	fingerprintKey = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, fingerprintKey)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Loads the fingerprint key that a previous daemon left behind, or creates
+// one for future daemons to use.
+func InitFingerprintKey() {
+	key, err := loadRandomHex(getFingerprintKeyPath(), 32)
+	if err != nil {
+		fail(1, fmt.Errorf("invalid fingerprint key: %s", err.Error()))
+	}
+
+	fingerprintKey, err = hex.DecodeString(key)
+	if err != nil {
+		fail(1, fmt.Errorf("invalid fingerprint key: %s", err.Error()))
+	}
+}
+
 //
 // Contains any functions that are called by multiple modules, but don't belong
 // in any in particular.
 //
 
+// Captures a request's headers and body so that it can be made again after
+// handlers further down the chain have changed or consumed them. Returns a
+// function that puts them back, which may be called any number of times.
+func captureRequest(r *http.Request) (func(), error) {
+	header := make(http.Header)
+	copyHeaders(r.Header, header)
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return func() {
+		r.Header = make(http.Header)
+		copyHeaders(header, r.Header)
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+	}, nil
+}
+
 func copyHeaders(source http.Header, destination http.Header) {
 	for h, vs := range source {
 		for _, v := range vs {
@@ -33,6 +108,34 @@ func fail(status int, err error) {
 	os.Exit(status)
 }
 
+func getEnvDuration(key string, value time.Duration) time.Duration {
+	s := os.Getenv(key)
+	if s == "" {
+		return value
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		fail(1, fmt.Errorf("invalid %s: %s", key, err.Error()))
+	}
+
+	return d
+}
+
+func getEnvInt(key string, value int) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return value
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		fail(1, fmt.Errorf("invalid %s: %s", key, err.Error()))
+	}
+
+	return i
+}
+
 func getPath(key string, value string) string {
 	path := os.Getenv(key)
 	if path == "" {
@@ -47,14 +150,91 @@ func getPath(key string, value string) string {
 	return path
 }
 
+// The on-disk cache is optional, so unlike the socket paths there is no
+// default and an empty string means that it's disabled.
+func getCacheDirPath() string {
+	if os.Getenv("HEROKU_AGENT_CACHE_DIR") == "" {
+		return ""
+	}
+	return getPath("HEROKU_AGENT_CACHE_DIR", "")
+}
+
 func getControlSocketPath() string {
 	return getPath("HEROKU_AGENT_CONTROL_SOCK", DefaultControlSocketPath)
 }
 
+// Like the install ID, the fingerprint key belongs to the daemon listening on
+// a particular socket.
+func getFingerprintKeyPath() string {
+	return getProxySocketPath() + ".fingerprint-key"
+}
+
+// The install ID lives alongside the proxy socket so that daemons listening
+// on different sockets never mistake each other's authorizations for their
+// own.
+func getInstallIdPath() string {
+	return getProxySocketPath() + ".install-id"
+}
+
+func getPolicyFilePath() string {
+	return getPath("HEROKU_AGENT_POLICY_FILE", DefaultPolicyFilePath)
+}
+
+// Like the on-disk cache, TOTP is optional and an empty string means that it's
+// disabled.
+func getTotpSecretPath() string {
+	if os.Getenv("HEROKU_AGENT_TOTP_SECRET_FILE") == "" {
+		return ""
+	}
+	return getPath("HEROKU_AGENT_TOTP_SECRET_FILE", "")
+}
+
 func getProxySocketPath() string {
 	return getPath("HEROKU_AGENT_SOCK", DefaultProxySocketPath)
 }
 
+// Derives a key from an authorization for use in maps. This is a keyed hash
+// so that anything which dumps keys doesn't also dump credentials.
+func authKey(rawAuth string) string {
+	mac := hmac.New(sha256.New, authKeySecret)
+	mac.Write([]byte(normalizeAuth(rawAuth)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Produces a short identifier for an authorization for display in logs and on
+// the command line. It's stable across daemons, but can't be reversed into a
+// usable credential, nor checked against one without the fingerprint key.
+func fingerprintAuth(rawAuth string) string {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(normalizeAuth(rawAuth)))
+	return hex.EncodeToString(mac.Sum(nil))[0:8]
+}
+
+// Reads a hex-encoded random value from the given file, generating one of
+// the given number of bytes and writing it there if there isn't one yet.
+func loadRandomHex(path string, size int) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if s := strings.TrimSpace(string(data)); s != "" {
+		return s, nil
+	}
+
+	b := make([]byte, size)
+	_, err = io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+
+	s := hex.EncodeToString(b)
+	err = ioutil.WriteFile(path, []byte(s+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
 // Normalizes the `Authorization` header.
 //
 // This isn't strictly necessary, but the API has a number of authentication
@@ -111,12 +291,22 @@ func printUsage() {
 
 // Unfortunately, the Toolbelt sends a user's password via query parameter,
 // which shows up in a stringified URL. This method scrubs that out for safe
-// display on-screen and in-logs.
+// display on-screen, in-logs, and anywhere else that it's kept. The raw query
+// is scrubbed so that a password that had to be escaped is caught too.
 func safeUrl(u *url.URL) string {
-	password := u.Query().Get("password")
-	s := u.String()
-	if password != "" {
-		s = strings.Replace(s, password, "[scrubbed]", 1)
+	if u.RawQuery == "" {
+		return u.String()
 	}
-	return s
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == "password" {
+			params[i] = key + "=[scrubbed]"
+		}
+	}
+
+	scrubbed := *u
+	scrubbed.RawQuery = strings.Join(params, "&")
+	return scrubbed.String()
 }
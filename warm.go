@@ -0,0 +1,372 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// The most endpoints that are remembered for any one identity. When there
+	// are more, the least used is forgotten.
+	MaxWarmEndpoints = 100
+)
+
+var (
+	warmer *CacheWarmer
+
+	// Request headers that are remembered so that an endpoint can be
+	// requested again exactly as the client requested it. The authorization
+	// isn't among them because it's held only in memory.
+	warmHeaders = []string{
+		"Accept",
+		"Range",
+		"User-Agent",
+		"X-Heroku-Sudo-User",
+	}
+)
+
+// How often a client has requested an endpoint, along with what's needed to
+// request it again. Fields are exported so that usage can be persisted.
+type EndpointUsage struct {
+	Count      int         `json:"count"`
+	Header     http.Header `json:"header"`
+	Host       string      `json:"host"`
+	LastUsedAt time.Time   `json:"last_used_at"`
+	Url        string      `json:"url"`
+}
+
+// Remembers which GET endpoints each identity requests most often so that
+// they can be prefetched into the cache before they're next needed.
+type CacheWarmer struct {
+	chain    NextHandlerFunc
+	dirty    bool
+	mutex    *sync.Mutex
+	seenMap  map[string]bool
+	usageMap map[string]map[string]*EndpointUsage
+
+	// The authorization last sent by each identity, which warming requests
+	// are made with. Unlike usage, these are never persisted, so after a
+	// restart an identity isn't warmed until it's seen again.
+	authMap map[string]string
+
+	// The number of endpoints to warm per identity. Zero disables warming
+	// entirely, along with the tracking of usage.
+	count int
+
+	// How often to warm every known identity. Zero means that an identity is
+	// only warmed the first time it's seen.
+	interval time.Duration
+}
+
+func init() {
+	warmer = &CacheWarmer{
+		authMap:  make(map[string]string),
+		mutex:    &sync.Mutex{},
+		seenMap:  make(map[string]bool),
+		usageMap: make(map[string]map[string]*EndpointUsage),
+	}
+}
+
+func ClearCacheWarmer() {
+	warmer.clear()
+}
+
+// Configures warming, and loads usage remembered by a previous daemon if the
+// cache is being persisted. Warming requests are made through the given
+// chain.
+func InitCacheWarmer(chain NextHandlerFunc) {
+	warmer.chain = chain
+	warmer.count = getEnvInt("HEROKU_AGENT_WARM_COUNT", 0)
+	warmer.interval = getEnvDuration("HEROKU_AGENT_WARM_INTERVAL", 0)
+
+	if warmer.count > 0 {
+		warmer.load()
+	}
+}
+
+// Persists usage so that a future daemon knows what to warm.
+func SaveCacheWarmer() {
+	warmer.save()
+}
+
+// Periodically persists usage, and warms every known identity if a schedule
+// has been configured.
+func RunCacheWarmer() {
+	if warmer.count <= 0 {
+		return
+	}
+
+	var warmTick <-chan time.Time
+	if warmer.interval > 0 {
+		warmTick = time.Tick(warmer.interval)
+	}
+
+	saveTick := time.Tick(5 * time.Minute)
+
+	for {
+		select {
+		case <-saveTick:
+			warmer.save()
+		case <-warmTick:
+			warmer.warmAll()
+		}
+	}
+}
+
+func WarmHandler(r *http.Request, next NextHandlerFunc) (*httptest.ResponseRecorder, error) {
+	auth := r.Header.Get("Authorization")
+	if warmer.count <= 0 || r.Method != "GET" || !hasAuth(auth) {
+		return next(r)
+	}
+
+	// handlers further down may swap in a privileged token, which mustn't be
+	// remembered, so the request is captured as the client made it
+	header := make(http.Header)
+	for _, h := range warmHeaders {
+		if v := r.Header.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+	host := r.Host
+	u := r.URL.String()
+
+	w, err := next(r)
+	if err != nil {
+		return w, err
+	}
+
+	// only remember endpoints that worked, that didn't need a one-time second
+	// factor, and that we'd be allowed to cache in the first place
+	if (w.Code != 200 && w.Code != 206) || r.Header.Get("Heroku-Two-Factor-Code") != "" ||
+		r.URL.Query().Get("password") != "" || !cache.policyFor(r).cache {
+		return w, err
+	}
+
+	identity := authKey(auth)
+	if warmer.record(identity, auth, host, u, header) {
+		go warmer.warm(identity)
+	}
+
+	return w, err
+}
+
+func (c *CacheWarmer) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	numIdentities := len(c.usageMap)
+	for k := range c.usageMap {
+		delete(c.usageMap, k)
+	}
+	for k := range c.authMap {
+		delete(c.authMap, k)
+	}
+	c.dirty = true
+	logger.Printf("[warm] Cleared usage for %v identities\n", numIdentities)
+}
+
+// Drops everything known about an identity.
+func (c *CacheWarmer) forget(identity string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.authMap, identity)
+	delete(c.seenMap, identity)
+	delete(c.usageMap, identity)
+	c.dirty = true
+}
+
+func (c *CacheWarmer) load() {
+	if cache.disk == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := cache.disk.loadUsage(&c.usageMap)
+	if err != nil {
+		logger.Printf("[warm] Discarding unreadable usage: %s\n", err.Error())
+		c.usageMap = make(map[string]map[string]*EndpointUsage)
+		return
+	}
+
+	// usage persisted by older versions included authorizations, which are
+	// dropped so that the file is rewritten without them
+	for _, endpoints := range c.usageMap {
+		for _, usage := range endpoints {
+			if usage.Header.Get("Authorization") != "" {
+				usage.Header.Del("Authorization")
+				c.dirty = true
+			}
+		}
+	}
+
+	logger.Printf("[warm] Loaded usage for %v identities\n", len(c.usageMap))
+}
+
+// Counts a use of the requested endpoint. Returns true if this is the first
+// time that the identity has been seen by this daemon, which is when it
+// should be warmed.
+func (c *CacheWarmer) record(identity string, auth string, host string, u string, header http.Header) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.authMap[identity] = auth
+
+	endpoints, ok := c.usageMap[identity]
+	if !ok {
+		endpoints = make(map[string]*EndpointUsage)
+		c.usageMap[identity] = endpoints
+	}
+
+	key := host + u + "|" + header.Get("Accept") + "|" +
+		header.Get("Range") + "|" + header.Get("X-Heroku-Sudo-User")
+	usage, ok := endpoints[key]
+	if !ok {
+		if len(endpoints) >= MaxWarmEndpoints {
+			forgetLeastUsed(endpoints)
+		}
+		usage = &EndpointUsage{
+			Host: host,
+			Url:  u,
+		}
+		endpoints[key] = usage
+	}
+
+	usage.Count++
+	usage.Header = header
+	usage.LastUsedAt = time.Now()
+	c.dirty = true
+
+	seen := c.seenMap[identity]
+	c.seenMap[identity] = true
+	return !seen
+}
+
+func (c *CacheWarmer) save() {
+	if cache.disk == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.dirty {
+		return
+	}
+
+	err := cache.disk.saveUsage(c.usageMap)
+	if err != nil {
+		logger.Printf("[warm] Error persisting usage: %s\n", err.Error())
+		return
+	}
+	c.dirty = false
+}
+
+// Requests the most used endpoints of an identity so that they're in the
+// cache. Requests are made one at a time to go easy on the API. An identity
+// whose authorization is refused is forgotten.
+func (c *CacheWarmer) warm(identity string) {
+	c.mutex.Lock()
+	auth, ok := c.authMap[identity]
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	usages := c.topEndpoints(identity)
+	logger.Printf("[warm] Warming %v endpoint(s)\n", len(usages))
+
+	for _, usage := range usages {
+		u, err := url.Parse(usage.Url)
+		if err != nil {
+			continue
+		}
+
+		r := &http.Request{
+			Header:     make(http.Header),
+			Host:       usage.Host,
+			Method:     "GET",
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			URL:        u,
+		}
+		copyHeaders(usage.Header, r.Header)
+		r.Header.Set("Authorization", auth)
+
+		w, err := c.chain(r)
+		if err != nil {
+			logger.Printf("[warm] Error warming %s%s: %s\n",
+				usage.Host, safeUrl(u), err.Error())
+			continue
+		}
+
+		if w.Code == 401 {
+			c.forget(identity)
+			logger.Printf("[warm] Authorization refused; forgot identity\n")
+			return
+		}
+	}
+}
+
+// Warms every identity whose authorization is held.
+func (c *CacheWarmer) warmAll() {
+	c.mutex.Lock()
+	identities := make([]string, 0, len(c.authMap))
+	for identity := range c.authMap {
+		identities = append(identities, identity)
+	}
+	c.mutex.Unlock()
+
+	for _, identity := range identities {
+		c.warm(identity)
+	}
+	c.save()
+}
+
+// Returns copies of an identity's most used endpoints, most used first.
+func (c *CacheWarmer) topEndpoints(identity string) []EndpointUsage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	usages := make([]EndpointUsage, 0, len(c.usageMap[identity]))
+	for _, usage := range c.usageMap[identity] {
+		usages = append(usages, *usage)
+	}
+
+	sort.Sort(byUsage(usages))
+	if len(usages) > c.count {
+		usages = usages[0:c.count]
+	}
+	return usages
+}
+
+func forgetLeastUsed(endpoints map[string]*EndpointUsage) {
+	var leastKey string
+	var least *EndpointUsage
+	for k, usage := range endpoints {
+		if least == nil || byUsage([]EndpointUsage{*least, *usage}).Less(0, 1) {
+			leastKey, least = k, usage
+		}
+	}
+	delete(endpoints, leastKey)
+}
+
+// Sorts endpoints from most to least used, with ties broken by whichever was
+// used most recently.
+type byUsage []EndpointUsage
+
+func (u byUsage) Len() int      { return len(u) }
+func (u byUsage) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u byUsage) Less(i, j int) bool {
+	if u[i].Count != u[j].Count {
+		return u[i].Count > u[j].Count
+	}
+	return u[i].LastUsedAt.After(u[j].LastUsedAt)
+}